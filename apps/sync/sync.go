@@ -22,6 +22,9 @@ func main() {
 	mainCmd, opts := cmd.CreateMainCommand()
 	mainCmd.AddCommand(cmd.CreateSendCommand(opts))
 	mainCmd.AddCommand(cmd.CreateServerCommand())
+	mainCmd.AddCommand(cmd.CreateSignatureCommand())
+	mainCmd.AddCommand(cmd.CreateDeltaCommand())
+	mainCmd.AddCommand(cmd.CreatePatchCommand())
 	if err := mainCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
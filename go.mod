@@ -5,9 +5,13 @@ go 1.20
 require (
 	github.com/google/go-cmp v0.5.9
 	github.com/spf13/cobra v1.6.1
+	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
+	"github.com/andreistan26/sync/src/file_level"
 	"github.com/andreistan26/sync/src/options"
 	"github.com/spf13/cobra"
 )
@@ -23,12 +25,92 @@ func CreateSendCommand(opts *options.Options) *cobra.Command {
 		Short: `send files(SRC) to syncronize with a target(DEST)`,
 		Args:  ArgsValidator(opts),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return Execute(opts)
+			return explain(Execute(opts))
 		},
 	}
 
 	command.Flags().BoolVarP(&opts.Verbose, "verbose", "v", true, "increase verbosity")
 	command.Flags().IntVar(&opts.Port, "Port", options.DEFAULT_PORT, "specify address port")
+	addParamsFlags(command, opts)
+	command.Flags().IntVar(&opts.Workers, "workers", 0, "goroutines used to compute signatures and search the source (0 uses every cpu)")
+	command.Flags().BoolVarP(&opts.WholeFile, "whole-file", "W", false,
+		"send the whole file without computing a delta, faster when the network is faster than the disks")
+	command.Flags().BoolVar(&opts.InPlace, "inplace", false,
+		"update the destination directly instead of writing a new copy, for files that do not fit twice on their volume")
+	addDeltaFlags(command, opts)
+	return command
+}
+
+// parameters the signatures are computed with
+func addParamsFlags(command *cobra.Command, opts *options.Options) {
+	command.Flags().Uint64Var(&opts.BlockSize, "block-size", 0, "force a fixed block size (0 picks one from the file size)")
+	command.Flags().StringVar(&opts.Hash, "hash", file_level.DefaultSyncParams().HashAlgorithm.String(),
+		fmt.Sprintf("strong hash algorithm, one of %v", file_level.HashAlgorithmNames()))
+	command.Flags().StringVar(&opts.Chunking, "chunking", file_level.CHUNKING_FIXED.String(),
+		"how files are split into blocks, fixed or cdc (content defined, block size is the average)")
+}
+
+// how the delta is encoded
+func addDeltaFlags(command *cobra.Command, opts *options.Options) {
+	command.Flags().BoolVarP(&opts.Compress, "compress", "z", false, "compress literal data")
+	command.Flags().BoolVar(&opts.SelfRefs, "self-refs", false,
+		"send data repeated in the source as a copy of its first occurrence (disables the parallel search)")
+	command.Flags().BoolVar(&opts.CompressBasis, "compress-basis", false,
+		"like --compress, using the destination blocks matched last as dictionary")
+	command.Flags().IntVar(&opts.CompressLevel, "compress-level", file_level.DEFAULT_COMPRESS_LEVEL,
+		"deflate level used by --compress, from 1 (fastest) to 9 (smallest)")
+	command.Flags().BoolVarP(&opts.Sparse, "sparse", "S", false,
+		"send runs of zeros as holes, the destination is written as a sparse file")
+}
+
+func CreateSignatureCommand() *cobra.Command {
+	opts := &options.Options{}
+	command := &cobra.Command{
+		Use:   `signature [opts] BASIS SIGFILE`,
+		Short: `write the block signatures of BASIS to SIGFILE`,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateParams(opts); err != nil {
+				return err
+			}
+			return explain(ExecuteSignature(opts, args[0], args[1]))
+		},
+	}
+
+	addParamsFlags(command, opts)
+	command.Flags().IntVar(&opts.Workers, "workers", 0, "goroutines used to compute signatures (0 uses every cpu)")
+	return command
+}
+
+func CreateDeltaCommand() *cobra.Command {
+	opts := &options.Options{}
+	command := &cobra.Command{
+		Use:   `delta [opts] SIGFILE NEWFILE DELTAFILE`,
+		Short: `write the delta that turns the file SIGFILE was made from into NEWFILE`,
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := file_level.ValidateCompressLevel(opts.CompressionLevel()); err != nil {
+				return err
+			}
+			return explain(ExecuteDelta(opts, args[0], args[1], args[2]))
+		},
+	}
+
+	command.Flags().IntVar(&opts.Workers, "workers", 0, "goroutines used to search NEWFILE (0 uses every cpu)")
+	addDeltaFlags(command, opts)
+	return command
+}
+
+func CreatePatchCommand() *cobra.Command {
+	opts := &options.Options{}
+	command := &cobra.Command{
+		Use:   `patch [opts] BASIS DELTAFILE OUTFILE`,
+		Short: `apply DELTAFILE to BASIS and write the result to OUTFILE`,
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return explain(ExecutePatch(opts, args[0], args[1], args[2]))
+		},
+	}
 	return command
 }
 
@@ -38,11 +120,21 @@ func CreateServerCommand() *cobra.Command {
 		Use:   `server [OPTIONS]`,
 		Short: `starts a server that listens for clients`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return ExecuteStartServer(opts)
+			for _, name := range opts.AllowedHashes {
+				if _, err := file_level.ParseHashAlgorithm(name); err != nil {
+					return err
+				}
+			}
+			return explain(ExecuteStartServer(opts))
 		},
 	}
 
 	command.Flags().IntVar(&opts.Port, "Port", options.DEFAULT_PORT, "specify port")
+	command.Flags().StringSliceVar(&opts.AllowedHashes, "allow-hash", options.DefaultAllowedHashes(),
+		fmt.Sprintf("strong hash algorithms clients may use, one or more of %v", file_level.HashAlgorithmNames()))
+	command.Flags().IntVar(&opts.Workers, "workers", 0, "goroutines used to compute signatures (0 uses every cpu)")
+	command.Flags().IntVar(&opts.MaxRedo, "max-redo", options.DEFAULT_MAX_REDO,
+		"passes with smaller blocks and a stronger hash when a synced file does not match the source")
 	return command
 }
 
@@ -54,7 +146,29 @@ func ArgsValidator(opts *options.Options) func(cmd *cobra.Command, args []string
 		if _, err = os.Stat(args[0]); err != nil {
 			return errors.New("source file does not exist")
 		}
-		opts.ParseArgument(args)
-		return nil
+		if err = opts.ParseArgument(args); err != nil {
+			return explain(err)
+		}
+		if err = file_level.ValidateCompressLevel(opts.CompressionLevel()); err != nil {
+			return err
+		}
+		if opts.InPlace && opts.CompressBasis {
+			// the receiver overwrites the blocks the dictionary is made of
+			return errors.New("--compress-basis can not be used with --inplace")
+		}
+		return validateParams(opts)
+	}
+}
+
+func validateParams(opts *options.Options) error {
+	if _, err := file_level.ParseHashAlgorithm(opts.Hash); err != nil {
+		return err
+	}
+	if _, err := file_level.ParseChunkingMode(opts.Chunking); err != nil {
+		return err
+	}
+	if opts.BlockSize != 0 {
+		return file_level.ValidateBlockSize(opts.BlockSize)
 	}
+	return nil
 }
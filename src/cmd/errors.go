@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/andreistan26/sync/src/file_level"
+	"github.com/andreistan26/sync/src/options"
+)
+
+// what the user can do about the errors of the sync packages
+var errorHints = []struct {
+	target error
+	hint   string
+}{
+	{file_level.ErrMissingBasis, "the file to update does not exist, check the destination path"},
+	{file_level.ErrShortRead, "a file changed size while it was read, run the command again once it is no longer written to"},
+	{file_level.ErrCorruptDelta, "the delta is damaged or was not written by sync delta"},
+	{file_level.ErrChunkIndex, "the delta refers to blocks the basis does not have, it was made for a different file"},
+	{file_level.ErrCorruptSignature, "the signature file is damaged or was not written by sync signature"},
+	{file_level.ErrDeltaResult, "the delta was made for a different basis"},
+	{options.ErrInvalidAddress, "remote destinations are written as user@host:/path"},
+}
+
+// prefixes err with a hint for the user, errors.Is still finds the original error
+func explain(err error) error {
+	for _, el := range errorHints {
+		if errors.Is(err, el.target) {
+			return fmt.Errorf("%s: %w", el.hint, err)
+		}
+	}
+	return err
+}
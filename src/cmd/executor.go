@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
 
 	"github.com/andreistan26/sync/src/file_level"
 	"github.com/andreistan26/sync/src/options"
@@ -20,17 +24,189 @@ func Execute(opts *options.Options) error {
 }
 
 func ExecuteHostExchange(opts *options.Options) error {
-	sf := file_level.CreateSourceFile(opts.Source.Filepath)
-	rf := file_level.CreateRemoteFile(opts.Dest.Filepath)
+	fsys := opts.FileSystem()
+	stats, err := fsys.Stat(opts.Source.Filepath)
+	if err != nil {
+		return err
+	}
+
+	params := opts.SyncParams(uint64(stats.Size()))
+	sf, err := file_level.CreateSourceFileFS(fsys, opts.Source.Filepath, params)
+	if err != nil {
+		return err
+	}
+	defer sf.File.Close()
+	sf.Sparse = opts.Sparse
+
+	// a missing destination has no basis to compute a delta against
+	if _, err := fsys.Stat(opts.Dest.Filepath); opts.WholeFile || errors.Is(err, fs.ErrNotExist) {
+		fsys.MkdirAll(path.Dir(opts.Dest.Filepath), os.ModePerm)
+		writer, err := file_level.NewWholeFileWriterFS(fsys, opts.Dest.Filepath, params)
+		if err != nil {
+			return err
+		}
+		if err := sf.WholeFileTo(writer); err != nil {
+			writer.Abort()
+			return err
+		}
+		return writer.Close()
+	}
+
+	rf, err := file_level.CreateRemoteFileStreamFS(fsys, opts.Dest.Filepath, params, opts.WorkerCount(), nil)
+	if err != nil {
+		return err
+	}
 	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		return err
+	}
+
+	ex.Workers = opts.WorkerCount()
+	ex.SelfRefs = opts.SelfRefs
+	ex.InPlace = opts.InPlace
+
+	var writer *file_level.SyncedFileWriter
+	if opts.InPlace {
+		writer, err = rf.NewInPlaceWriter()
+	} else {
+		writer, err = rf.NewSyncedFileWriter(opts.Dest.Filepath, true)
+	}
+	if err != nil {
+		return err
+	}
+	if err := ex.SearchTo(writer); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
 
-	file_level.CheckErr(err)
+// writes the signatures of basisPath as they are computed
+func ExecuteSignature(opts *options.Options, basisPath, sigPath string) error {
+	fsys := opts.FileSystem()
+	stats, err := fsys.Stat(basisPath)
+	if err != nil {
+		return err
+	}
+	params := opts.SyncParams(uint64(stats.Size()))
 
-	resp := ex.Search()
+	sigFile, err := createFile(fsys, sigPath)
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
 
-	rf.WriteSyncedFile(&resp, opts.Dest.Filepath, true)
+	sigw, err := file_level.NewSignatureWriter(sigFile, params)
+	if err == nil {
+		_, err = file_level.CreateRemoteFileStreamFS(fsys, basisPath, params, opts.WorkerCount(), sigw.WriteChunks)
+	}
+	if err == nil {
+		err = sigw.Close()
+	}
+	if err == nil {
+		err = sigFile.Close()
+	}
+	if err != nil {
+		fsys.Remove(sigPath)
+	}
+	return err
+}
+
+func ExecuteDelta(opts *options.Options, sigPath, newPath, deltaPath string) error {
+	fsys := opts.FileSystem()
+	sigFile, err := fsys.OpenFile(sigPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	rf, err := file_level.ReadSignature(sigFile)
+	sigFile.Close()
+	if err != nil {
+		return err
+	}
+
+	header, err := file_level.CreateDeltaHeaderFS(fsys, newPath, rf.Params)
+	if err != nil {
+		return err
+	}
+	sf, err := file_level.CreateSourceFileFS(fsys, newPath, rf.Params)
+	if err != nil {
+		return err
+	}
+	defer sf.File.Close()
+	sf.Sparse = opts.Sparse
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		return err
+	}
+	ex.Workers = opts.WorkerCount()
+	ex.SelfRefs = opts.SelfRefs
+
+	deltaFile, err := createFile(fsys, deltaPath)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	dw, err := file_level.NewDeltaWriter(deltaFile, header)
+	var sink file_level.PacketSink = dw
+	if level := opts.CompressionLevel(); err == nil && opts.CompressBasis {
+		sink, err = ex.NewBasisCompressSink(dw, level)
+	} else if err == nil && level != 0 {
+		sink, err = file_level.NewCompressSink(dw, level)
+	}
+
+	if err == nil {
+		err = ex.SearchTo(sink)
+	}
+	if err == nil {
+		err = dw.Close()
+	}
+	if err == nil {
+		err = deltaFile.Close()
+	}
+	if err != nil {
+		fsys.Remove(deltaPath)
+	}
+	return err
+}
+
+// the result is checked against the size and hash in the delta
+// before it replaces outPath
+func ExecutePatch(opts *options.Options, basisPath, deltaPath, outPath string) error {
+	fsys := opts.FileSystem()
+	deltaFile, err := fsys.OpenFile(deltaPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	dr, err := file_level.NewDeltaReader(deltaFile)
+	if err != nil {
+		return err
+	}
+	// the delta only needs the chunk offsets, the basis is not hashed
+	rf, err := file_level.CreatePatchBasisFS(fsys, basisPath, dr.Header.Params)
+	if err != nil {
+		return err
+	}
+
+	writer, err := rf.NewSyncedFileWriter(outPath, false)
+	if err != nil {
+		return err
+	}
+	if err := dr.WriteTo(writer); err != nil {
+		writer.Abort()
+		return err
+	}
+	// outPath is only written once the result matches the delta
+	return writer.CloseChecked(func(filePath string) error {
+		return dr.Header.VerifyFS(fsys, filePath)
+	})
+}
 
-	return nil
+// like os.Create on fsys
+func createFile(fsys file_level.FS, filePath string) (file_level.File, error) {
+	return fsys.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
 func ExecuteTCPExchange(opts *options.Options) error {
@@ -39,9 +215,9 @@ func ExecuteTCPExchange(opts *options.Options) error {
 }
 
 func ExecuteStartServer(opts *options.ServerOptions) error {
-	serv, err := transport.StartServer(options.DEFAULT_PORT)
+	serv, err := transport.StartServer(opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	return serv.Run()
 }
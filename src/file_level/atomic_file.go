@@ -0,0 +1,73 @@
+package file_level
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// permissions of a new destination, what os.Create gives with the usual umask
+const NEW_FILE_PERM = 0644
+
+// creates a temporary file next to filePath with a name no other sync uses.
+// Being in the same directory lets it be renamed over filePath atomically,
+// it gets the permissions of filePath when that already exists
+func createTemp(fsys FS, filePath string) (File, string, error) {
+	dir, base := filepath.Split(filePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	// the names os.CreateTemp picks, but on any FS
+	var file File
+	var tmpPath string
+	var err error
+	for try := 0; try < 10000; try++ {
+		tmpPath = filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		file, err = fsys.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	perm := os.FileMode(NEW_FILE_PERM)
+	if stats, err := fsys.Stat(filePath); err == nil {
+		perm = stats.Mode().Perm()
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		fsys.Remove(tmpPath)
+		return nil, "", err
+	}
+	return file, tmpPath, nil
+}
+
+// moves the closed temporary file over filePath. The rename replaces
+// filePath in one step, a crash leaves either the old or the new file.
+// The file is already synced, the directory is synced so the rename
+// itself survives a crash
+func commitTemp(fsys FS, tmpPath, filePath string) error {
+	if err := fsys.Rename(tmpPath, filePath); err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+	return syncDir(fsys, filepath.Dir(filePath))
+}
+
+func syncDir(fsys FS, dir string) error {
+	file, err := fsys.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,173 @@
+package file_level
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+type ChunkingMode uint8
+
+const (
+	// blocks cut at every BlockSize bytes, matched with the rolling checksum
+	CHUNKING_FIXED ChunkingMode = iota
+	// blocks cut on content defined boundaries, matched by strong hash only
+	CHUNKING_CDC
+)
+
+var (
+	ErrUnknownChunking = errors.New("unknown chunking mode")
+)
+
+var chunkingNames = map[ChunkingMode]string{
+	CHUNKING_FIXED: "fixed",
+	CHUNKING_CDC:   "cdc",
+}
+
+func ParseChunkingMode(name string) (ChunkingMode, error) {
+	for mode, modeName := range chunkingNames {
+		if modeName == strings.ToLower(name) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownChunking, name)
+}
+
+func (mode ChunkingMode) Validate() error {
+	if _, ok := chunkingNames[mode]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownChunking, mode)
+	}
+	return nil
+}
+
+func (mode ChunkingMode) String() string {
+	if name, ok := chunkingNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", mode)
+}
+
+// FastCDC content defined chunking
+// Source : https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+// the block size is used as the average chunk size, rounded down to a power of 2,
+// chunks are between a quarter and four times that size
+type CDCChunker struct {
+	reader io.Reader
+
+	minSize uint64
+	avgSize uint64
+	maxSize uint64
+	maskS   uint64
+	maskL   uint64
+
+	buffer []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+// the gear table has to be the same on both sides, so it is generated
+// from a fixed seed with splitmix64 instead of math/rand
+var gearTable = func() (table [256]uint64) {
+	var state uint64 = 0x5359_4e43_4344_4321
+	for idx := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[idx] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+func cdcAvgSize(blockSize uint64) uint64 {
+	return 1 << (bits.Len64(blockSize) - 1)
+}
+
+// largest chunk the CDC chunker can produce for a block size
+func CDCMaxSize(blockSize uint64) uint64 {
+	return cdcAvgSize(blockSize) * 4
+}
+
+func NewCDCChunker(reader io.Reader, blockSize uint64) *CDCChunker {
+	avgSize := cdcAvgSize(blockSize)
+	avgBits := bits.Len64(avgSize) - 1
+
+	// normalized chunking, harder to cut before the average size, easier after it
+	return &CDCChunker{
+		reader:  reader,
+		minSize: avgSize / 4,
+		avgSize: avgSize,
+		maxSize: avgSize * 4,
+		maskS:   ^uint64(0) << (64 - (avgBits + 1)),
+		maskL:   ^uint64(0) << (64 - (avgBits - 1)),
+		buffer:  make([]byte, avgSize*8),
+	}
+}
+
+// the returned slice is only valid until the next call,
+// returns io.EOF once every byte was returned
+func (c *CDCChunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cutPoint(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// makes sure at least maxSize bytes are buffered unless the reader is done
+func (c *CDCChunker) fill() error {
+	if c.eof || uint64(c.end-c.start) >= c.maxSize {
+		return nil
+	}
+
+	copy(c.buffer, c.buffer[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.reader, c.buffer[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+func (c *CDCChunker) cutPoint(data []byte) int {
+	size := uint64(len(data))
+	if size <= c.minSize {
+		return len(data)
+	}
+	if size > c.maxSize {
+		size = c.maxSize
+	}
+	normal := c.avgSize
+	if size < normal {
+		normal = size
+	}
+
+	var fp uint64
+	idx := c.minSize
+	for ; idx < normal; idx++ {
+		fp = (fp << 1) + gearTable[data[idx]]
+		if fp&c.maskS == 0 {
+			return int(idx + 1)
+		}
+	}
+	for ; idx < size; idx++ {
+		fp = (fp << 1) + gearTable[data[idx]]
+		if fp&c.maskL == 0 {
+			return int(idx + 1)
+		}
+	}
+	return int(size)
+}
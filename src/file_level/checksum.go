@@ -11,17 +11,20 @@ const (
 	CHUNK_SIZE     = 4096
 	SW_BUFFER_SIZE = CHUNK_SIZE * 4
 	MOD2_16        = 1 << 16
+
+	// the sliding window buffer holds this many blocks at once
+	SW_BUFFER_BLOCKS = 4
 )
 
 var (
 	ErrSWStuck   = errors.New("no more bytes to slide")
-	ErrSWSize    = errors.New("sliding window size is not equal to CHUNK_SIZE")
+	ErrSWSize    = errors.New("sliding window size is not equal to the block size")
 	ErrSWSizeRem = errors.New("sliding window is stuck but still has data to be read")
 )
 
 type Chunk struct {
 	CheckSum   CheckSum
-	StrongHash [16]byte
+	StrongHash []byte
 
 	Offset uint64
 	Size   uint64
@@ -31,9 +34,11 @@ type Chunk struct {
 type SlidingWindow struct {
 	checkSum CheckSum
 
-	buffer    [CHUNK_SIZE * 4]byte
+	buffer    []byte
 	readBytes uint64
 	cap       uint64
+	blockSize uint64
+	rolling   RollingChecksum
 
 	k_idx uint64
 	l_idx uint64
@@ -41,8 +46,16 @@ type SlidingWindow struct {
 	b_sum uint32
 }
 
+func NewSlidingWindow(blockSize uint64) SlidingWindow {
+	return SlidingWindow{
+		buffer:    make([]byte, SW_BUFFER_BLOCKS*blockSize),
+		blockSize: blockSize,
+		l_idx:     blockSize - 1,
+	}
+}
+
 func (sw *SlidingWindow) GetBuffer() []byte {
-	if (sw.l_idx - sw.k_idx + 1) != CHUNK_SIZE {
+	if (sw.l_idx - sw.k_idx + 1) != sw.blockSize {
 		panic(ErrSWSize)
 	}
 	return sw.buffer[sw.k_idx : sw.l_idx+1]
@@ -55,10 +68,6 @@ func (sw *SlidingWindow) GetBuffer() []byte {
 // b(k, l) = (sum i=k->l : (l-i+1) * x_i ) % MOD2_16
 // checkSum = a(k, l) + MOD2_16 * b(k, l)
 func NewCheckSum(bytes []byte) (sum CheckSum, a_sum, b_sum uint32) {
-	signExtend := func(b byte) uint32 {
-		return uint32(int32(uint32(b)<<24) >> 24)
-	}
-
 	chunk_len := len(bytes)
 
 	for idx, el := range bytes {
@@ -71,14 +80,30 @@ func NewCheckSum(bytes []byte) (sum CheckSum, a_sum, b_sum uint32) {
 	return sum, a_sum, b_sum
 }
 
-var offset_map = [2]uint64{
-	A_BLOCK: 1,
-	B_BLOCK: CHUNK_SIZE,
+func signExtend(b byte) uint32 {
+	return uint32(int32(uint32(b)<<24) >> 24)
+}
+
+// slides the checksum of a window of size bytes by one byte,
+// out is the byte leaving the window and in the one entering it
+func RollCheckSum(a_sum, b_sum uint32, size uint64, out, in byte) (sum CheckSum, new_a, new_b uint32) {
+	new_a = a_sum - signExtend(out) + signExtend(in)
+	new_b = b_sum - uint32(size)*signExtend(out) + new_a
+	sum = CheckSum(new_a)&0xffff | CheckSum(new_b)<<16
+	return sum, new_a, new_b
+}
+
+// how far the window advances after a packet of the given type
+func (sw *SlidingWindow) offset(respType ResponseType) uint64 {
+	if respType == B_BLOCK {
+		return sw.blockSize
+	}
+	return 1
 }
 
 func (sw *SlidingWindow) CheckStuck(respType ResponseType) (err error) {
 
-	if sw.cap <= (sw.l_idx + offset_map[respType]) {
+	if sw.cap <= (sw.l_idx + sw.offset(respType)) {
 		return ErrSWSize
 	}
 	return nil
@@ -88,9 +113,9 @@ func (sw *SlidingWindow) RollChunk() error {
 	if sw.CheckStuck(B_BLOCK) == ErrSWSize {
 		return ErrSWSizeRem
 	}
-	sw.k_idx += CHUNK_SIZE
-	sw.l_idx += CHUNK_SIZE
-	sw.checkSum, sw.a_sum, sw.b_sum = NewCheckSum(sw.GetBuffer())
+	sw.k_idx += sw.blockSize
+	sw.l_idx += sw.blockSize
+	sw.checkSum, sw.a_sum, sw.b_sum = sw.rolling.Sum(sw.GetBuffer())
 	return nil
 }
 
@@ -100,18 +125,11 @@ func (sw *SlidingWindow) Roll() error {
 		return ErrSWSizeRem
 	}
 
-	signExtend := func(b byte) uint32 {
-		return uint32(int32(uint32(b)<<24) >> 24)
-	}
-
 	sw.k_idx++
 	sw.l_idx++
 
-	sw.a_sum = (sw.a_sum - signExtend(sw.buffer[sw.k_idx-1]) +
-		signExtend(sw.buffer[sw.l_idx])) //% MOD2_16
-	sw.b_sum = (sw.b_sum - CHUNK_SIZE*signExtend(sw.buffer[sw.k_idx-1]) +
-		sw.a_sum) //% MOD2_16
-	sw.checkSum = CheckSum(sw.a_sum)&0xffff | CheckSum(sw.b_sum)<<16
+	sw.checkSum, sw.a_sum, sw.b_sum = sw.rolling.Roll(sw.a_sum, sw.b_sum, sw.blockSize,
+		sw.buffer[sw.k_idx-1], sw.buffer[sw.l_idx])
 
 	return nil
 }
@@ -119,7 +137,7 @@ func (sw *SlidingWindow) Roll() error {
 func (chunk Chunk) String() string {
 	chunkStr := fmt.Sprintf(
 		"checksum : %v \n "+
-			"md5 hash : %v \n "+
+			"strong   : %x \n "+
 			"offset   : %v \n "+
 			"size     : %v \n ",
 		chunk.CheckSum, chunk.StrongHash,
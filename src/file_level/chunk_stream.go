@@ -0,0 +1,53 @@
+package file_level
+
+import (
+	"sync"
+)
+
+const (
+	// number of chunks sent together while streaming signatures
+	SIGNATURE_BATCH_SIZE = 1024
+)
+
+// remote chunks that keep arriving in batches while the search is running
+type ChunkStream struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	batches [][]Chunk
+	done    bool
+	err     error
+}
+
+func NewChunkStream() *ChunkStream {
+	cs := &ChunkStream{}
+	cs.cond = sync.NewCond(&cs.mu)
+	return cs
+}
+
+// batches must come in Index order and are not copied
+func (cs *ChunkStream) Add(batch []Chunk) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.batches = append(cs.batches, batch)
+	cs.cond.Broadcast()
+}
+
+// marks the end of the stream, err is handed to the search if not nil
+func (cs *ChunkStream) Close(err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.done = true
+	cs.err = err
+	cs.cond.Broadcast()
+}
+
+// returns the batches after the first from ones, when wait is set
+// it blocks until there is at least one or the stream is done
+func (cs *ChunkStream) next(from int, wait bool) (batches [][]Chunk, done bool, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for wait && len(cs.batches) == from && !cs.done {
+		cs.cond.Wait()
+	}
+	return cs.batches[from:], cs.done, cs.err
+}
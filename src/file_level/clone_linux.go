@@ -0,0 +1,48 @@
+package file_level
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl that shares the blocks of a range of one file with another, btrfs and XFS
+const FICLONERANGE = 0x4020940d
+
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+// makes size bytes of dst from dstOffset share the blocks of src from srcOffset,
+// nothing is copied. The file offsets stay where they were
+func cloneRange(dst, src *os.File, dstOffset, srcOffset, size uint64) error {
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var dstErr error
+	var errno syscall.Errno
+	err = srcConn.Control(func(srcFd uintptr) {
+		args := fileCloneRange{int64(srcFd), srcOffset, size, dstOffset}
+		dstErr = dstConn.Control(func(dstFd uintptr) {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dstFd, FICLONERANGE, uintptr(unsafe.Pointer(&args)))
+		})
+	})
+	switch {
+	case err != nil:
+		return err
+	case dstErr != nil:
+		return dstErr
+	case errno != 0:
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package file_level
+
+import (
+	"errors"
+	"os"
+)
+
+var errCloneUnsupported = errors.New("ranges can only be cloned on Linux")
+
+// ranges are always copied outside of Linux
+func cloneRange(dst, src *os.File, dstOffset, srcOffset, size uint64) error {
+	return errCloneUnsupported
+}
@@ -0,0 +1,312 @@
+package file_level
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// compression level used when only --compress is given
+	DEFAULT_COMPRESS_LEVEL = 6
+	// deflate never looks further back than this, larger dictionaries are useless
+	DICT_SIZE = 32 << 10
+)
+
+var (
+	ErrInvalidCompressLevel = errors.New("invalid compression level")
+	ErrCompressedSize       = errors.New("compressed packet inflates past the largest literal")
+	ErrDictionary           = errors.New("invalid compression dictionary")
+)
+
+// 0 turns compression off
+func ValidateCompressLevel(level int) error {
+	if level != 0 && (level < flate.BestSpeed || level > flate.BestCompression) {
+		return fmt.Errorf("%w: %d not in [%d, %d]", ErrInvalidCompressLevel,
+			level, flate.BestSpeed, flate.BestCompression)
+	}
+	return nil
+}
+
+// deflates the data of every A_BLOCK packet into a Z_BLOCK packet before
+// handing it to sink, packets that do not get smaller are sent as they are.
+// Every packet is compressed on its own so the receiver can apply it alone
+type CompressSink struct {
+	sink   PacketSink
+	level  int
+	writer *flate.Writer
+	buffer bytes.Buffer
+
+	// set when the basis chunks matched last prime the compressor
+	basis *basisDict
+}
+
+func NewCompressSink(sink PacketSink, level int) (*CompressSink, error) {
+	if err := ValidateCompressLevel(level); err != nil {
+		return nil, err
+	}
+	if level == 0 {
+		return nil, fmt.Errorf("%w: compression is off", ErrInvalidCompressLevel)
+	}
+
+	writer, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressSink{sink: sink, level: level, writer: writer}, nil
+}
+
+// like NewCompressSink, but literals that follow a match are deflated with
+// the chunks matched last as preset dictionary and sent as D_BLOCK packets.
+// The sender never sees the basis file, the bytes of a matched chunk are
+// read from the source where it matched, the receiver reads them from its basis.
+// A source made with NewSourceFile can not be read twice, it is ErrNoRandomAccess
+func (ex *RsyncExchange) NewBasisCompressSink(sink PacketSink, level int) (*CompressSink, error) {
+	if ex.sourceFile.source == nil {
+		return nil, fmt.Errorf("%w: basis compression needs the matched source data", ErrNoRandomAccess)
+	}
+	cs, err := NewCompressSink(sink, level)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.basis = &basisDict{
+		source:  ex.sourceFile.source,
+		chunkAt: ex.chunkAt,
+	}
+	return cs, nil
+}
+
+func (cs *CompressSink) WritePacket(packet ResponsePacket) error {
+	if cs.basis != nil {
+		if err := cs.basis.track(packet); err != nil {
+			return err
+		}
+	}
+	if packet.BlockType != A_BLOCK {
+		return cs.sink.WritePacket(packet)
+	}
+
+	if cs.basis != nil && len(cs.basis.recent) > 0 {
+		return cs.writeWithDict(packet)
+	}
+
+	compressed, err := deflate(cs.writer, &cs.buffer, nil, packet.Data)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(packet.Data) {
+		return cs.sink.WritePacket(packet)
+	}
+	return cs.sink.WritePacket(ResponsePacket{
+		Z_BLOCK,
+		compressed,
+	})
+}
+
+// D_BLOCK data is the uvarint count of dictionary chunks,
+// their uvarint indexes and the deflated literal
+func (cs *CompressSink) writeWithDict(packet ResponsePacket) error {
+	writer, err := cs.basis.dictWriter(cs.level)
+	if err != nil {
+		return err
+	}
+
+	header := binary.AppendUvarint(nil, uint64(len(cs.basis.recent)))
+	for _, chunk := range cs.basis.recent {
+		header = binary.AppendUvarint(header, chunk.index)
+	}
+
+	data, err := deflate(writer, &cs.buffer, header, packet.Data)
+	if err != nil {
+		return err
+	}
+	if len(data) >= len(packet.Data) {
+		return cs.sink.WritePacket(packet)
+	}
+	return cs.sink.WritePacket(ResponsePacket{
+		D_BLOCK,
+		data,
+	})
+}
+
+// returns prefix followed by the compressed data, in a new slice
+// since the sink may keep the packet and the buffer is reused
+func deflate(writer *flate.Writer, buffer *bytes.Buffer, prefix, data []byte) ([]byte, error) {
+	buffer.Reset()
+	buffer.Write(prefix)
+	writer.Reset(buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.Bytes()...), nil
+}
+
+type dictChunk struct {
+	index uint64
+	// where the chunk matched in the source
+	offset uint64
+	size   uint64
+}
+
+// the chunks matched last, at most DICT_SIZE bytes not counting the oldest one
+type basisDict struct {
+	source  io.ReaderAt
+	chunkAt func(idx uint64) (*Chunk, error)
+
+	// source offset of the next packet
+	offset uint64
+	recent []dictChunk
+	size   uint64
+
+	// primed with the current dictionary, nil after it changed
+	writer *flate.Writer
+}
+
+func (bd *basisDict) track(packet ResponsePacket) error {
+	switch packet.BlockType {
+	case A_BLOCK:
+		bd.offset += uint64(len(packet.Data))
+	case H_BLOCK:
+		size, err := packet.ZeroRun()
+		if err != nil {
+			return err
+		}
+		bd.offset += size
+	case S_BLOCK:
+		_, size, err := packet.SelfRange()
+		if err != nil {
+			return err
+		}
+		bd.offset += size
+	case B_BLOCK, R_BLOCK:
+		first, last, err := packet.ChunkRange()
+		if err != nil {
+			return err
+		}
+		firstChunk, err := bd.chunkAt(first)
+		if err != nil {
+			return err
+		}
+		lastChunk, err := bd.chunkAt(last)
+		if err != nil {
+			return err
+		}
+		end := bd.offset + lastChunk.Offset + lastChunk.Size - firstChunk.Offset
+
+		// only the end of a long range can end up in the dictionary
+		idx := last
+		var tail uint64
+		for ; idx > first && tail < DICT_SIZE; idx-- {
+			chunk, err := bd.chunkAt(idx)
+			if err != nil {
+				return err
+			}
+			tail += chunk.Size
+		}
+
+		for ; idx <= last; idx++ {
+			chunk, err := bd.chunkAt(idx)
+			if err != nil {
+				return err
+			}
+			bd.recent = append(bd.recent, dictChunk{idx, bd.offset + chunk.Offset - firstChunk.Offset, chunk.Size})
+			bd.size += chunk.Size
+			for bd.size-bd.recent[0].size >= DICT_SIZE {
+				bd.size -= bd.recent[0].size
+				bd.recent = bd.recent[1:]
+			}
+		}
+		bd.writer = nil
+		bd.offset = end
+	default:
+		return fmt.Errorf("%w: %v", ErrPacketType, packet.BlockType)
+	}
+	return nil
+}
+
+func (bd *basisDict) dictWriter(level int) (*flate.Writer, error) {
+	if bd.writer != nil {
+		return bd.writer, nil
+	}
+
+	dict := make([]byte, 0, bd.size)
+	for _, chunk := range bd.recent {
+		data := make([]byte, chunk.size)
+		if err := readFullAt(bd.source, data, chunk.offset); err != nil {
+			return nil, err
+		}
+		dict = append(dict, data...)
+	}
+
+	writer, err := flate.NewWriterDict(nil, level, dict)
+	if err != nil {
+		return nil, err
+	}
+	bd.writer = writer
+	return writer, nil
+}
+
+// inflates the data of Z_BLOCK and D_BLOCK packets, reusing one decompressor
+type inflater struct {
+	reader io.ReadCloser
+}
+
+// at most limit bytes are accepted, so a corrupt packet can not
+// make the receiver allocate without bound
+func (inf *inflater) inflate(data, dict []byte, limit uint64) ([]byte, error) {
+	if inf.reader == nil {
+		inf.reader = flate.NewReaderDict(bytes.NewReader(data), dict)
+	} else if err := inf.reader.(flate.Resetter).Reset(bytes.NewReader(data), dict); err != nil {
+		return nil, err
+	}
+
+	res, err := io.ReadAll(io.LimitReader(inf.reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(res)) > limit {
+		return nil, ErrCompressedSize
+	}
+	return res, nil
+}
+
+// reads the dictionary a D_BLOCK packet names from the basis file,
+// returns it together with the compressed data
+func (w *SyncedFileWriter) readDict(data []byte) (dict, compressed []byte, err error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, ErrDictionary
+	}
+	data = data[n:]
+
+	maxSize := DICT_SIZE + w.remoteFile.Params.MaxChunkSize()
+	for ; count > 0; count-- {
+		idx, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, ErrDictionary
+		}
+		data = data[n:]
+
+		chunk, err := w.remoteFile.chunkAt(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(dict))+chunk.Size > maxSize {
+			return nil, nil, fmt.Errorf("%w: larger than %d bytes", ErrDictionary, maxSize)
+		}
+
+		start := len(dict)
+		dict = append(dict, make([]byte, chunk.Size)...)
+		if err := readFullAt(w.basis, dict[start:], chunk.Offset); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dict, data, nil
+}
@@ -0,0 +1,258 @@
+package file_level
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Delta file format, every integer is little endian
+//
+//	magic          4 bytes  "SYDF"
+//	version        uint16   DELTA_VERSION
+//	block size     uint64
+//	hash algorithm uint8    HashAlgorithm value
+//	chunking       uint8    ChunkingMode value
+//	source length  uint64
+//	file hash      uint8 length, then the hash of the whole source file
+//
+// followed by the packets, each one is
+//
+//	type           uint8    ResponseType value
+//	length         uvarint
+//	data           length bytes, the same as ResponsePacket.Data
+//
+// and an end record, DELTA_END followed by the uvarint number of packets,
+// so a truncated file is never mistaken for a complete one
+const (
+	DELTA_MAGIC   = "SYDF"
+	DELTA_VERSION = 1
+	DELTA_END     = 0xff
+	// largest packet data a reader accepts
+	MAX_DELTA_PACKET_SIZE = 1 << 24
+)
+
+var (
+	ErrDeltaMagic   = errors.New("not a delta file")
+	ErrDeltaVersion = errors.New("unsupported delta file version")
+	ErrCorruptDelta = errors.New("corrupt delta file")
+	ErrDeltaResult  = errors.New("patched file does not match the delta")
+)
+
+// what a delta was computed with and what applying it has to produce
+type DeltaHeader struct {
+	Params     SyncParams
+	SourceSize uint64
+	FileHash   []byte
+}
+
+// header of a delta that rebuilds the file at filePath
+func CreateDeltaHeader(filePath string, params SyncParams) (DeltaHeader, error) {
+	return CreateDeltaHeaderFS(OSFS{}, filePath, params)
+}
+
+// like CreateDeltaHeader for a file of fsys
+func CreateDeltaHeaderFS(fsys FS, filePath string, params SyncParams) (DeltaHeader, error) {
+	stats, err := fsys.Stat(filePath)
+	if err != nil {
+		return DeltaHeader{}, err
+	}
+	fileHash, err := GetFileHashFS(fsys, filePath, params.HashAlgorithm)
+	if err != nil {
+		return DeltaHeader{}, err
+	}
+	return DeltaHeader{Params: params, SourceSize: uint64(stats.Size()), FileHash: fileHash}, nil
+}
+
+// checks the file a delta was applied to against the size and hash of the source
+func (header DeltaHeader) Verify(filePath string) error {
+	return header.VerifyFS(OSFS{}, filePath)
+}
+
+// like Verify for a file of fsys
+func (header DeltaHeader) VerifyFS(fsys FS, filePath string) error {
+	stats, err := fsys.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if uint64(stats.Size()) != header.SourceSize {
+		return fmt.Errorf("%w: %d bytes, want %d", ErrDeltaResult, stats.Size(), header.SourceSize)
+	}
+
+	fileHash, err := GetFileHashFS(fsys, filePath, header.Params.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fileHash, header.FileHash) {
+		return fmt.Errorf("%w: %v is %x, want %x", ErrDeltaResult,
+			header.Params.HashAlgorithm, fileHash, header.FileHash)
+	}
+	return nil
+}
+
+// writes a delta file, implements PacketSink
+type DeltaWriter struct {
+	writer *bufio.Writer
+	count  uint64
+}
+
+// writes the header right away, Close has to be called after the last packet
+func NewDeltaWriter(w io.Writer, header DeltaHeader) (*DeltaWriter, error) {
+	if len(header.FileHash) > 0xff {
+		return nil, fmt.Errorf("%w: file hash of %d bytes", ErrCorruptDelta, len(header.FileHash))
+	}
+
+	buf := []byte(DELTA_MAGIC)
+	buf = binary.LittleEndian.AppendUint16(buf, DELTA_VERSION)
+	buf = binary.LittleEndian.AppendUint64(buf, header.Params.BlockSize)
+	buf = append(buf, byte(header.Params.HashAlgorithm), byte(header.Params.Chunking))
+	buf = binary.LittleEndian.AppendUint64(buf, header.SourceSize)
+	buf = append(buf, byte(len(header.FileHash)))
+	buf = append(buf, header.FileHash...)
+
+	dw := &DeltaWriter{writer: bufio.NewWriter(w)}
+	if _, err := dw.writer.Write(buf); err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+func (dw *DeltaWriter) WritePacket(packet ResponsePacket) error {
+	if packet.BlockType < 0 || packet.BlockType >= DELTA_END {
+		return fmt.Errorf("%w: %v", ErrPacketType, packet.BlockType)
+	}
+
+	buf := binary.AppendUvarint([]byte{byte(packet.BlockType)}, uint64(len(packet.Data)))
+	if _, err := dw.writer.Write(buf); err != nil {
+		return err
+	}
+	if _, err := dw.writer.Write(packet.Data); err != nil {
+		return err
+	}
+	dw.count++
+	return nil
+}
+
+// writes the end record and flushes, the underlying writer is not closed
+func (dw *DeltaWriter) Close() error {
+	if _, err := dw.writer.Write(binary.AppendUvarint([]byte{DELTA_END}, dw.count)); err != nil {
+		return err
+	}
+	return dw.writer.Flush()
+}
+
+type DeltaReader struct {
+	Header DeltaHeader
+
+	reader *bufio.Reader
+	count  uint64
+	done   bool
+}
+
+// reads and checks the header
+func NewDeltaReader(r io.Reader) (*DeltaReader, error) {
+	dr := &DeltaReader{reader: bufio.NewReader(r)}
+
+	fixed := make([]byte, len(DELTA_MAGIC)+2+8+1+1+8+1)
+	if _, err := io.ReadFull(dr.reader, fixed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeltaMagic, err)
+	}
+	if string(fixed[:len(DELTA_MAGIC)]) != DELTA_MAGIC {
+		return nil, ErrDeltaMagic
+	}
+	fixed = fixed[len(DELTA_MAGIC):]
+
+	if version := binary.LittleEndian.Uint16(fixed); version != DELTA_VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrDeltaVersion, version)
+	}
+	dr.Header.Params = SyncParams{
+		BlockSize:     binary.LittleEndian.Uint64(fixed[2:]),
+		HashAlgorithm: HashAlgorithm(fixed[10]),
+		Chunking:      ChunkingMode(fixed[11]),
+	}
+	dr.Header.SourceSize = binary.LittleEndian.Uint64(fixed[12:])
+
+	dr.Header.FileHash = make([]byte, fixed[20])
+	if _, err := io.ReadFull(dr.reader, dr.Header.FileHash); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptDelta, err)
+	}
+
+	if err := dr.Header.Params.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptDelta, err)
+	}
+	return dr, nil
+}
+
+// the next packet, io.EOF after the end record
+func (dr *DeltaReader) Next() (ResponsePacket, error) {
+	if dr.done {
+		return ResponsePacket{}, io.EOF
+	}
+
+	blockType, err := dr.reader.ReadByte()
+	if err != nil {
+		return ResponsePacket{}, dr.corrupt(err)
+	}
+	length, err := binary.ReadUvarint(dr.reader)
+	if err != nil {
+		return ResponsePacket{}, dr.corrupt(err)
+	}
+
+	if blockType == DELTA_END {
+		if length != dr.count {
+			return ResponsePacket{}, fmt.Errorf("%w: %d packets, the end record says %d",
+				ErrCorruptDelta, dr.count, length)
+		}
+		dr.done = true
+		return ResponsePacket{}, io.EOF
+	}
+
+	if length > MAX_DELTA_PACKET_SIZE {
+		return ResponsePacket{}, fmt.Errorf("%w: packet of %d bytes", ErrCorruptDelta, length)
+	}
+	packet := ResponsePacket{
+		ResponseType(blockType),
+		make([]byte, length),
+	}
+	if _, err := io.ReadFull(dr.reader, packet.Data); err != nil {
+		return ResponsePacket{}, dr.corrupt(err)
+	}
+	dr.count++
+	return packet, nil
+}
+
+// hands every remaining packet to sink
+func (dr *DeltaReader) WriteTo(sink PacketSink) error {
+	for {
+		packet, err := dr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sink.WritePacket(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// the file ends before the end record
+func (dr *DeltaReader) corrupt(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrCorruptDelta, err)
+}
+
+func (header DeltaHeader) String() string {
+	return fmt.Sprintf(
+		"source size : %v \n "+
+			"file hash   : %x \n "+
+			"%v",
+		header.SourceSize, header.FileHash, header.Params,
+	)
+}
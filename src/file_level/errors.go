@@ -1,7 +1,41 @@
 package file_level
 
-func CheckErr(err error) {
-	if err != nil {
-		panic(err)
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// errors of the file_level API other than the ones of a single format,
+// every function returns them wrapped with %w, check them with errors.Is.
+// Chunk indexes out of range are ErrChunkIndex, corrupt deltas ErrCorruptDelta
+var (
+	// the basis, the file a delta is applied to, does not exist
+	ErrMissingBasis = errors.New("basis file does not exist")
+	// a file ended before the bytes a delta or a chunk needs, it changed while it was used
+	ErrShortRead = errors.New("file is shorter than expected")
+	// a source or output that is only a stream was asked to read data again
+	ErrNoRandomAccess = errors.New("stream does not support random access")
+)
+
+// opens the basis with flag, a missing file is ErrMissingBasis
+func openBasis(fsys FS, filePath string, flag int) (File, error) {
+	file, err := fsys.OpenFile(filePath, flag, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", ErrMissingBasis, err)
+	}
+	return file, err
+}
+
+// reads len(buf) bytes of file at offset, a file that ends before is ErrShortRead
+func readFullAt(file io.ReaderAt, buf []byte, offset uint64) error {
+	n, err := file.ReadAt(buf, int64(offset))
+	if n == len(buf) {
+		return nil
+	}
+	if err == io.EOF {
+		return fmt.Errorf("%w: %d of %d bytes at %d", ErrShortRead, n, len(buf), offset)
 	}
+	return err
 }
@@ -1,116 +1,481 @@
 package file_level
 
 import (
-	"crypto/md5"
-	"encoding/binary"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
 type RsyncExchange struct {
 	sourceFile *SourceFile
+	hasher     StrongHasher
 	ChunkList  []Chunk
 	HashMap    HashMap
+
+	// CDC mode looks chunks up by strong hash only
+	strongMap map[string]*Chunk
+	// identical chunks are indexed once, every copy of an indexed chunk
+	// is kept here in offset order, the indexed one first
+	copies map[*Chunk][]*Chunk
+
+	// set while remote chunks are still arriving
+	stream *ChunkStream
+	pulled int
+	// end of the basis data covered by the chunks received so far
+	received uint64
+
+	// the last remote chunk when it is shorter than a block
+	tailChunk *Chunk
+
+	// number of regions of the source searched at once, fixed chunking only
+	Workers int
+
+	// also match data the search already sent as literals, see self_ref.go
+	SelfRefs bool
+	selfMap  map[CheckSum][]selfRef
+	// CDC mode looks literals up by strong hash only
+	selfStrong map[string]selfRef
+
+	// the receiver updates its basis in place, see inplace.go
+	InPlace bool
 }
 
 type HashMap map[CheckSum][]*Chunk
 
+var (
+	ErrBlockSizeMismatch = errors.New("remote chunks do not match the block size of the source file")
+)
+
 func CreateRsyncExchange(sf *SourceFile, remoteChunks []Chunk) (RsyncExchange, error) {
+	ex, err := newRsyncExchange(sf)
+	if err != nil {
+		return ex, err
+	}
+	return ex, ex.addChunks(remoteChunks)
+}
+
+// the search can start before every remote chunk arrived, it only waits
+// for more of them when the current window does not match anything yet
+// and lies past the basis data received so far, see findMatch
+func CreateStreamingRsyncExchange(sf *SourceFile, stream *ChunkStream) (RsyncExchange, error) {
+	ex, err := newRsyncExchange(sf)
+	ex.stream = stream
+	return ex, err
+}
+
+func newRsyncExchange(sf *SourceFile) (RsyncExchange, error) {
+	hasher, err := sf.Params.newHasher()
+	if err != nil {
+		return RsyncExchange{}, err
+	}
+
 	ex := RsyncExchange{
 		sourceFile: sf,
-		ChunkList:  remoteChunks,
+		hasher:     hasher,
 		HashMap:    make(HashMap),
 	}
+	if sf.Params.Chunking == CHUNKING_CDC {
+		ex.strongMap = make(map[string]*Chunk)
+	}
+	return ex, nil
+}
 
-	for idx := range remoteChunks {
-		ex.HashMap[ex.ChunkList[idx].CheckSum] = append(ex.HashMap[ex.ChunkList[idx].CheckSum], &ex.ChunkList[idx])
+// indexes the chunks in place, they must not be modified afterwards
+func (ex *RsyncExchange) addChunks(chunks []Chunk) error {
+	var prev uint64
+	if len(ex.ChunkList) > 0 {
+		prev = ex.ChunkList[len(ex.ChunkList)-1].Size
+	}
+	// a short chunk is only valid as the last one, the sizes are checked first
+	for idx := range chunks {
+		if !ex.sourceFile.Params.validChunkSize(chunks[idx].Size, prev) {
+			return ErrBlockSizeMismatch
+		}
+		prev = chunks[idx].Size
+	}
+	for idx := range chunks {
+		if len(chunks[idx].StrongHash) != ex.hasher.Size() {
+			return ErrHashSizeMismatch
+		}
 	}
 
-	return ex, nil
+	if ex.ChunkList == nil {
+		ex.ChunkList = chunks
+	} else {
+		ex.ChunkList = append(ex.ChunkList, chunks...)
+	}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		ex.received = last.Offset + last.Size
+	}
+
+	for idx := range chunks {
+		chunk := &chunks[idx]
+		if ex.strongMap != nil {
+			if indexed, ok := ex.strongMap[string(chunk.StrongHash)]; ok {
+				ex.addCopy(indexed, chunk)
+			} else {
+				ex.strongMap[string(chunk.StrongHash)] = chunk
+			}
+		} else if chunk.Size < ex.sourceFile.BlockSize() {
+			// never matches a full window, only the end of the source
+			ex.tailChunk = chunk
+		} else if indexed := ex.indexedChunk(chunk); indexed != nil {
+			ex.addCopy(indexed, chunk)
+		} else {
+			ex.HashMap[chunk.CheckSum] = append(ex.HashMap[chunk.CheckSum], chunk)
+		}
+	}
+	return nil
+}
+
+// identical remote chunks (zero pages in disk images for example) are only
+// indexed once, so the buckets of the hashmap stay short
+func (ex *RsyncExchange) indexedChunk(chunk *Chunk) *Chunk {
+	for _, other := range ex.HashMap[chunk.CheckSum] {
+		if bytes.Equal(other.StrongHash, chunk.StrongHash) {
+			return other
+		}
+	}
+	return nil
+}
+
+// chunks arrive in offset order, so the copies stay sorted
+func (ex *RsyncExchange) addCopy(indexed, chunk *Chunk) {
+	if ex.copies == nil {
+		ex.copies = make(map[*Chunk][]*Chunk)
+	}
+	if len(ex.copies[indexed]) == 0 {
+		ex.copies[indexed] = []*Chunk{indexed}
+	}
+	ex.copies[indexed] = append(ex.copies[indexed], chunk)
+}
+
+// a match of chunk idx can also be sent as a copy of chunk next,
+// when both hold the same data
+func (ex *RsyncExchange) sameChunk(idx, next uint64) bool {
+	if idx >= uint64(len(ex.ChunkList)) || next >= uint64(len(ex.ChunkList)) {
+		return false
+	}
+	chunk, other := &ex.ChunkList[idx], &ex.ChunkList[next]
+	return chunk.Size == other.Size && bytes.Equal(chunk.StrongHash, other.StrongHash)
+}
+
+// a remote chunk the search already received
+func (ex *RsyncExchange) chunkAt(idx uint64) (*Chunk, error) {
+	if idx >= uint64(len(ex.ChunkList)) {
+		return nil, fmt.Errorf("%w: %d of %d", ErrChunkIndex, idx, len(ex.ChunkList))
+	}
+	return &ex.ChunkList[idx], nil
+}
+
+// indexes the chunks that arrived since the last call, when wait is set
+// it blocks until new chunks arrive, returns false once no more can arrive
+func (ex *RsyncExchange) pullChunks(wait bool) (bool, error) {
+	if ex.stream == nil {
+		return false, nil
+	}
+
+	batches, done, err := ex.stream.next(ex.pulled, wait)
+	if err != nil {
+		return false, err
+	}
+	for _, batch := range batches {
+		if err := ex.addChunks(batch); err != nil {
+			return false, err
+		}
+	}
+	ex.pulled += len(batches)
+
+	if done && len(batches) == 0 {
+		ex.stream = nil
+		return false, nil
+	}
+	return len(batches) > 0, nil
+}
+
+// a chunk matching the current window, if one is known.
+// matched chunks stay in the map so repeated blocks can reuse them
+func (ex *RsyncExchange) matchWindow(pos uint64) *Chunk {
+	res := ex.HashMap[ex.sourceFile.slidingWin.checkSum]
+	if len(res) == 0 {
+		return nil
+	}
+
+	// the strong hash is expensive, compute it once for all candidates
+	strongHash := ex.hasher.Sum(ex.sourceFile.slidingWin.GetBuffer())
+
+	// linear search hashmap value at found key
+	for _, chunk := range res {
+		// check if candidate has the same strong hash as the window
+		if bytes.Equal(chunk.StrongHash, strongHash) {
+			return ex.inPlaceMatch(chunk, pos)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Checksum matched but strongHash didn't, %v vals\n", res)
+	return nil
 }
 
-// copy pasted from https://stackoverflow.com/questions/37334119/how-to-delete-an-element-from-a-slice-in-golang
-// apparently one of the only safe ways to do this smh
-func RemoveIndex(s []*Chunk, index int) []*Chunk {
-	ret := make([]*Chunk, len(s)-1)
-	ret = append(ret, s[:index]...)
-	return append(ret, s[index+1:]...)
+// like matchWindow, but before giving up it looks for the window in the
+// literals sent so far and at the chunks that arrived in the meantime.
+// Chunks arrive in basis order, so the ones still on their way only cover
+// basis data after the part received so far. A window that matches nothing
+// waits for them while it lies past that part, inside of it the window
+// becomes literal data right away, so literals are not held back until the
+// last chunk arrived. Data of the basis still to come that the source moved
+// towards its start is then sent as a literal, a search that had every
+// chunk from the start would have matched it
+func (ex *RsyncExchange) findMatch(pos uint64) (*Chunk, *selfRef, error) {
+	for {
+		if chunk := ex.matchWindow(pos); chunk != nil {
+			return chunk, nil, nil
+		}
+		if ref := ex.matchSelf(); ref != nil {
+			return nil, ref, nil
+		}
+		if more, err := ex.pullChunks(ex.awaitsChunks(pos, ex.sourceFile.BlockSize())); !more || err != nil {
+			return nil, nil, err
+		}
+	}
 }
 
-func (ex *RsyncExchange) Search() (response Response) {
+// the source data of size bytes at pos is past the basis data
+// received so far, see findMatch
+func (ex *RsyncExchange) awaitsChunks(pos, size uint64) bool {
+	return pos+size > ex.received
+}
+
+// collects the whole delta in memory, use SearchTo for large files
+func (ex *RsyncExchange) Search() (response Response, err error) {
+	err = ex.SearchTo(&response)
+	return response, err
+}
+
+func newBlockPacket(chunk *Chunk) ResponsePacket {
+	return newIndexPacket(B_BLOCK, chunk.Index)
+}
+
+// hands every packet to the sink as soon as it is produced,
+// so memory usage does not depend on the size of the delta
+// runs of consecutive matched chunks are sent as R_BLOCK packets
+func (ex *RsyncExchange) SearchTo(sink PacketSink) error {
+	var sparse *sparseSink
+	if ex.sourceFile.Sparse {
+		sparse = newSparseSink(sink, ex.chunkAt, ex.hasher)
+		sink = sparse
+	}
+
+	ranges := newRangeSink(sink, ex.sameChunk)
+	if err := ex.search(ranges); err != nil {
+		return err
+	}
+	if err := ranges.Flush(); err != nil {
+		return err
+	}
+	if sparse != nil {
+		return sparse.Flush()
+	}
+	return nil
+}
+
+func (ex *RsyncExchange) search(sink PacketSink) error {
+	if ex.sourceFile.Params.Chunking == CHUNKING_CDC {
+		return ex.searchCDC(sink)
+	}
+
+	// literals are only known once the search before them is done
+	parallel := ex.Workers > 1 && !ex.SelfRefs && ex.sourceFile.source != nil
+
+	sw := &ex.sourceFile.slidingWin
+	if sw.cap < ex.sourceFile.BlockSize() {
+		// the source is shorter than a block, there is no full window to search
+		return ex.emitTail(sink, sw.buffer[:sw.cap])
+	}
+
 	var packetAData []byte
+	// source offset of the window
+	var pos uint64
 	var err error = nil
+	var sinkErr error = nil
 SearchLoop:
-	for err == nil {
-
-		// check if current checksum is entry in the hashmap
-		if res := ex.HashMap[ex.sourceFile.slidingWin.checkSum]; len(res) > 0 {
-			// linear search hashmap value at found key
-			for idx, chunk := range res {
-
-				// check if candidate has the same strong hash as the window
-				if chunk.StrongHash == md5.Sum(ex.sourceFile.slidingWin.GetBuffer()) {
-					// empty the type A buffer into a packet and
-					// append it to reonstruction header
-					if len(packetAData) > 0 {
-						response = append(response, ResponsePacket{
-							A_BLOCK,
-							packetAData,
-						})
-						packetAData = nil
-					}
-
-					// construct the type B packet
-					idxBytes := make([]byte, 8)
-					binary.LittleEndian.PutUint64(idxBytes, chunk.Index)
-					response = append(response, ResponsePacket{
-						B_BLOCK,
-						idxBytes,
-					})
-
-					// remove chunk from hashmap value list
-					// TODO optimize this ugly thing
-
-					ex.HashMap[ex.sourceFile.slidingWin.checkSum] = RemoveIndex(res, idx)
-					err = ex.sourceFile.Next(B_BLOCK)
-					continue SearchLoop
+	for err == nil && sinkErr == nil {
+		// the parallel search needs every remote chunk, while they are
+		// streaming the windows that match the ones already received or
+		// lie within the basis data they cover are searched here, the rest
+		// of the source once the stream is done
+		if parallel && len(packetAData) == 0 {
+			if _, pullErr := ex.pullChunks(false); pullErr != nil {
+				return pullErr
+			}
+			if ex.stream == nil {
+				return ex.searchParallel(sink, ex.sourceFile.source, pos, ex.sourceFile.FileSize)
+			}
+		}
+
+		// check if the current window matches a remote chunk
+		chunk, ref, matchErr := ex.findMatch(pos)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		if chunk != nil || ref != nil {
+			// empty the type A buffer into a packet and
+			// send it before the match
+			if len(packetAData) > 0 {
+				if sinkErr = sink.WritePacket(ResponsePacket{
+					A_BLOCK,
+					packetAData,
+				}); sinkErr != nil {
+					break SearchLoop
 				}
+				packetAData = nil
 			}
-			fmt.Fprintf(os.Stderr, "Checksum matched but strongHash didn't, %v vals\n", ex.HashMap[ex.sourceFile.slidingWin.checkSum])
+
+			// construct the type B packet
+			packet := ResponsePacket{}
+			if chunk != nil {
+				packet = newBlockPacket(chunk)
+			} else {
+				packet = newSelfPacket(ref)
+			}
+			if sinkErr = sink.WritePacket(packet); sinkErr != nil {
+				break SearchLoop
+			}
+
+			pos += ex.sourceFile.BlockSize()
+			err = ex.sourceFile.Next(B_BLOCK)
+			continue SearchLoop
 		}
 
 		packetAData = append(packetAData, ex.sourceFile.slidingWin.buffer[ex.sourceFile.slidingWin.k_idx])
 
 		// construction of the type A packet
 		// also checking the buffer size in order to manage memory usage
-		if len(packetAData) == CHUNK_SIZE {
-			response = append(response, ResponsePacket{
+		if uint64(len(packetAData)) == ex.sourceFile.BlockSize() {
+			ex.indexLiteral(packetAData, pos+1-ex.sourceFile.BlockSize())
+			sinkErr = sink.WritePacket(ResponsePacket{
 				A_BLOCK,
 				packetAData,
 			})
 			packetAData = nil
 		}
+		pos++
 		err = ex.sourceFile.Next(A_BLOCK)
 	}
 
+	if sinkErr != nil {
+		return sinkErr
+	}
+
 	if err == ErrSWSizeRem {
-		packetAData = append(packetAData, ex.sourceFile.slidingWin.buffer[ex.sourceFile.slidingWin.l_idx+1:ex.sourceFile.slidingWin.cap]...)
-		for len(packetAData) > 0 {
-			var dim int
+		packetAData = append(packetAData, sw.buffer[sw.l_idx+1:sw.cap]...)
+		return ex.emitTail(sink, packetAData)
+	}
 
-			if len(packetAData) < CHUNK_SIZE {
-				dim = len(packetAData)
-			} else {
-				dim = CHUNK_SIZE
+	return nil
+}
+
+// the last remote chunk can be shorter than a block, it can only match
+// the end of the source file, like the shrinking final window of rsync.
+// tail holds every byte after the last match
+func (ex *RsyncExchange) emitTail(sink PacketSink, tail []byte) error {
+	// the short chunk is the last one, it may still be on its way
+	for more := len(tail) > 0; more; {
+		var err error
+		if more, err = ex.pullChunks(true); err != nil {
+			return err
+		}
+	}
+
+	var match *Chunk
+	if chunk := ex.tailChunk; chunk != nil && chunk.Size <= uint64(len(tail)) {
+		window := tail[uint64(len(tail))-chunk.Size:]
+		if checkSum, _, _ := ex.sourceFile.Params.Rolling.Sum(window); checkSum == chunk.CheckSum &&
+			bytes.Equal(ex.hasher.Sum(window), chunk.StrongHash) {
+			// the whole source is read by now, a stream has no FileSize
+			match = ex.inPlaceMatch(chunk, ex.sourceFile.slidingWin.readBytes-chunk.Size)
+		}
+		if match != nil {
+			tail = tail[:uint64(len(tail))-chunk.Size]
+		}
+	}
+
+	for len(tail) > 0 {
+		var dim int
+
+		if uint64(len(tail)) < ex.sourceFile.BlockSize() {
+			dim = len(tail)
+		} else {
+			dim = int(ex.sourceFile.BlockSize())
+		}
+
+		if err := sink.WritePacket(ResponsePacket{
+			A_BLOCK,
+			tail[:dim],
+		}); err != nil {
+			return err
+		}
+		tail = tail[dim:]
+	}
+
+	if match != nil {
+		return sink.WritePacket(newBlockPacket(match))
+	}
+	return nil
+}
+
+// every source chunk is either a known remote chunk or literal data,
+// so there is no rolling search, just one lookup per chunk
+func (ex *RsyncExchange) searchCDC(sink PacketSink) error {
+	// source offset of the chunk
+	var pos uint64
+	for {
+		buf, err := ex.sourceFile.chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		strongHash := string(ex.hasher.Sum(buf))
+		chunk, ok := ex.strongMap[strongHash]
+		for !ok {
+			// a chunk that has not arrived yet could still match, see findMatch
+			more, err := ex.pullChunks(ex.awaitsChunks(pos, uint64(len(buf))))
+			if err != nil {
+				return err
 			}
+			if !more {
+				break
+			}
+			chunk, ok = ex.strongMap[strongHash]
+		}
 
-			response = append(response, ResponsePacket{
+		if ok && chunk.Size == uint64(len(buf)) {
+			chunk = ex.inPlaceMatch(chunk, pos)
+			ok = chunk != nil
+		}
+
+		packet := ResponsePacket{}
+		if ok && chunk.Size == uint64(len(buf)) {
+			packet = newBlockPacket(chunk)
+		} else if ref := ex.matchSelfCDC(strongHash, buf); ref != nil {
+			packet = newSelfPacket(ref)
+		} else {
+			ex.indexLiteralCDC(strongHash, buf, pos)
+			// the chunker reuses its buffer
+			packet = ResponsePacket{
 				A_BLOCK,
-				packetAData[:dim],
-			})
-			packetAData = packetAData[dim:]
+				append([]byte(nil), buf...),
+			}
 		}
-	}
 
-	return response
+		if err := sink.WritePacket(packet); err != nil {
+			return err
+		}
+		pos += uint64(len(buf))
+	}
 }
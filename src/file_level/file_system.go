@@ -0,0 +1,125 @@
+package file_level
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// the file system the files of a sync are read from and written to.
+// Names are paths like the ones os takes, the errors wrap the io/fs ones,
+// so a missing file is fs.ErrNotExist. OSFS is the real file system,
+// MemFS one in memory and SubFS the subtree of another one
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// replaces newpath when it exists
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// an open file of an FS, *os.File is one. The files of OSFS and of a
+// SubFS on top of it stay *os.File, only they get the kernel copies,
+// reflinks and holes
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Chmod(mode fs.FileMode) error
+}
+
+// the file system of the os package
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// a nil *os.File would be a non nil File
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// fsys, or the real file system when it is nil
+func OrOS(fsys FS) FS {
+	if fsys == nil {
+		return OSFS{}
+	}
+	return fsys
+}
+
+// the files of dir in fsys, names are relative to dir and can not leave it
+// with "..". A symbolic link of the real file system can still point out of it
+type subFS struct {
+	fsys FS
+	dir  string
+}
+
+func SubFS(fsys FS, dir string) FS {
+	return &subFS{OrOS(fsys), dir}
+}
+
+func (sub *subFS) join(name string) string {
+	// cleaned as an absolute path first, so ".." stops at dir
+	return filepath.Join(sub.dir, filepath.Clean(string(filepath.Separator)+name))
+}
+
+// errors name the file the way the caller did, not where it is in fsys
+func (sub *subFS) pathErr(err error, name string) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	return err
+}
+
+func (sub *subFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := sub.fsys.OpenFile(sub.join(name), flag, perm)
+	return file, sub.pathErr(err, name)
+}
+
+func (sub *subFS) Stat(name string) (fs.FileInfo, error) {
+	stats, err := sub.fsys.Stat(sub.join(name))
+	return stats, sub.pathErr(err, name)
+}
+
+func (sub *subFS) Rename(oldpath, newpath string) error {
+	err := sub.fsys.Rename(sub.join(oldpath), sub.join(newpath))
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return &os.LinkError{Op: linkErr.Op, Old: oldpath, New: newpath, Err: linkErr.Err}
+	}
+	return sub.pathErr(err, oldpath)
+}
+
+func (sub *subFS) Remove(name string) error {
+	return sub.pathErr(sub.fsys.Remove(sub.join(name)), name)
+}
+
+func (sub *subFS) MkdirAll(path string, perm fs.FileMode) error {
+	return sub.pathErr(sub.fsys.MkdirAll(sub.join(path), perm), path)
+}
@@ -2,30 +2,50 @@ package file_level
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 )
 
 type RemoteFile struct {
-	File     *os.File
+	// set when the remote file was made from a path, it is closed
+	// once the chunks are computed and the writers open FilePath again
+	File     File
 	FilePath string
+	// the file system of FilePath, nil is the real one
+	fs FS
 
 	ChunkList  []Chunk
 	ChunkCount uint64
+	Params     SyncParams
+
+	// the basis of a remote file made from an io.ReaderAt, the writers copy from it
+	basis io.ReaderAt
+	// holes of the file, the chunks in them are not read
+	holes []hole
+	// sums of a full block of zeros, set when there are holes
+	zeroChunk *Chunk
 }
 
-// for the strongHash we are using MD5
+// the strongHash algorithm is part of SyncParams,
 // rsync is based on MD4
 
 type SourceFile struct {
-	File     *os.File
+	// set when the source file was made from a path, the caller closes it
+	File File
+	// 0 for a source read from an io.Reader, its size is only known at the end
 	FileSize uint64
 	reader   *bufio.Reader
+	// random access to the source, nil for an io.Reader
+	source io.ReaderAt
+	Params SyncParams
+	// runs of zeros are sent as H_BLOCK packets, see sparse.go
+	Sparse bool
 
 	slidingWin SlidingWindow
+	holes      []hole
+	// only set in CDC mode, replaces the sliding window
+	chunker *CDCChunker
 }
 
 func (sf *SourceFile) Next(respType ResponseType) (err error) {
@@ -44,112 +64,267 @@ func (sf *SourceFile) Next(respType ResponseType) (err error) {
 	return err
 }
 
-func CreateRemoteFile(filePath string) RemoteFile {
+func CreateRemoteFile(filePath string) (RemoteFile, error) {
+	return CreateRemoteFileWithParams(filePath, DefaultSyncParams())
+}
+
+func CreateRemoteFileWithParams(filePath string, params SyncParams) (RemoteFile, error) {
+	return CreateRemoteFileStream(filePath, params, 1, nil)
+}
+
+// computes the chunk list like CreateRemoteFileWithParams but also hands every
+// SIGNATURE_BATCH_SIZE new chunks to sendBatch, so they can be sent
+// while the rest of the file is still being read.
+// with more than one worker the chunks are hashed concurrently
+func CreateRemoteFileStream(filePath string, params SyncParams, workers int, sendBatch func([]Chunk) error) (RemoteFile, error) {
+	return CreateRemoteFileStreamFS(OSFS{}, filePath, params, workers, sendBatch)
+}
+
+// like CreateRemoteFileStream for a file of fsys, the writers
+// of the remote file write to fsys as well
+func CreateRemoteFileStreamFS(fsys FS, filePath string, params SyncParams, workers int, sendBatch func([]Chunk) error) (RemoteFile, error) {
 	var rf RemoteFile
 	var err error
 
 	rf.FilePath = filePath
-	rf.File, err = os.Open(filePath)
+	rf.Params = params
+	rf.fs = fsys
+	rf.File, err = openBasis(fsys, filePath, os.O_RDONLY)
 	if err != nil {
-		panic(err)
+		return rf, err
 	}
 
 	defer rf.File.Close()
 
-	r := bufio.NewReader(rf.File)
-	for ; ; rf.ChunkCount++ {
-		buf := make([]byte, CHUNK_SIZE)
+	stats, err := rf.File.Stat()
+	if err != nil {
+		return rf, err
+	}
+	return rf, rf.computeChunks(rf.File, uint64(stats.Size()), workers, sendBatch)
+}
+
+// remote file for a basis of size bytes that is not a local file,
+// the writers copy from basis so it has to stay readable
+func NewRemoteFile(basis io.ReaderAt, size int64, params SyncParams) (RemoteFile, error) {
+	return NewRemoteFileStream(basis, size, params, 1, nil)
+}
+
+// like CreateRemoteFileStream for a basis that is not a local file
+func NewRemoteFileStream(basis io.ReaderAt, size int64, params SyncParams, workers int, sendBatch func([]Chunk) error) (RemoteFile, error) {
+	rf := RemoteFile{Params: params, basis: basis}
+	return rf, rf.computeChunks(basis, uint64(size), workers, sendBatch)
+}
+
+func (rf *RemoteFile) computeChunks(basis io.ReaderAt, size uint64, workers int, sendBatch func([]Chunk) error) error {
+	hasher, err := rf.Params.newHasher()
+	if err != nil {
+		return err
+	}
+	if file, ok := basis.(*os.File); ok {
+		rf.findHoles(file, size, hasher)
+	}
+
+	if workers > 1 {
+		return rf.chunkParallel(basis, size, hasher, workers, sendBatch)
+	}
+
+	sent := 0
+	flush := func(force bool) error {
+		if sendBatch == nil || len(rf.ChunkList) == sent {
+			return nil
+		}
+		if force || len(rf.ChunkList)-sent >= SIGNATURE_BATCH_SIZE {
+			batch := rf.ChunkList[sent:]
+			sent = len(rf.ChunkList)
+			return sendBatch(batch)
+		}
+		return nil
+	}
+	addChunk := func(chunk Chunk) error {
+		rf.ChunkList = append(rf.ChunkList, chunk)
+		return flush(false)
+	}
 
-		n, err := r.Read(buf)
+	r := bufio.NewReader(&holeReader{file: basis, holes: rf.holes, size: size})
+	if rf.Params.Chunking == CHUNKING_CDC {
+		err = rf.chunkCDC(r, hasher, addChunk)
+	} else {
+		err = rf.chunkFixed(r, hasher, addChunk)
+	}
+	if err != nil {
+		return err
+	}
+	return flush(true)
+}
 
-		if n == 0 {
+// remote file that only knows where the chunks of the basis are, enough to
+// apply a delta to it but not to search against it. Nothing is hashed,
+// with CDC the basis is read once to find the chunk boundaries
+func CreatePatchBasis(filePath string, params SyncParams) (RemoteFile, error) {
+	return CreatePatchBasisFS(OSFS{}, filePath, params)
+}
 
-			if err == io.EOF {
-				break
-			}
+// like CreatePatchBasis for a file of fsys
+func CreatePatchBasisFS(fsys FS, filePath string, params SyncParams) (RemoteFile, error) {
+	rf := RemoteFile{FilePath: filePath, Params: params, fs: fsys}
+	file, err := openBasis(fsys, filePath, os.O_RDONLY)
+	if err != nil {
+		return rf, err
+	}
+	defer file.Close()
 
-			if err != nil {
-				panic(err)
-			}
+	stats, err := file.Stat()
+	if err != nil {
+		return rf, err
+	}
+	queue := func(job *signatureJob) bool {
+		rf.ChunkList = append(rf.ChunkList, job.chunks...)
+		return true
+	}
+	if params.Chunking == CHUNKING_CDC {
+		return rf, rf.cutCDCRegions(file, uint64(stats.Size()), queue)
+	}
+	rf.cutFixedRegions(uint64(stats.Size()), queue)
+	return rf, nil
+}
 
-		} else if n < CHUNK_SIZE {
+// the last chunk is shorter than a block when the file size is not a multiple of it
+func (rf *RemoteFile) chunkFixed(r io.Reader, hasher StrongHasher, addChunk func(Chunk) error) error {
+	for ; ; rf.ChunkCount++ {
+		buf := make([]byte, rf.Params.BlockSize)
+
+		n, err := io.ReadFull(r, buf)
+
+		if err == io.EOF {
 			break
 		}
 
-		checkSum, _, _ := NewCheckSum(buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		buf = buf[:n]
+		offset := rf.ChunkCount * rf.Params.BlockSize
+		checkSum, strongHash := rf.sumChunk(buf, offset, hasher)
 
-		rf.ChunkList = append(rf.ChunkList, Chunk{
+		if err := addChunk(Chunk{
 			checkSum,
-			md5.Sum(buf),
-			rf.ChunkCount * CHUNK_SIZE,
+			strongHash,
+			offset,
 			uint64(n),
 			rf.ChunkCount,
-		})
+		}); err != nil {
+			return err
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			rf.ChunkCount++
+			break
+		}
 	}
+	return nil
+}
+
+func (rf *RemoteFile) chunkCDC(r io.Reader, hasher StrongHasher, addChunk func(Chunk) error) error {
+	chunker := NewCDCChunker(r, rf.Params.BlockSize)
+	var offset uint64
+	for ; ; rf.ChunkCount++ {
+		buf, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 
-	return rf
+		// chunks are matched by strong hash only, no need for a weak checksum
+		if err := addChunk(Chunk{
+			StrongHash: hasher.Sum(buf),
+			Offset:     offset,
+			Size:       uint64(len(buf)),
+			Index:      rf.ChunkCount,
+		}); err != nil {
+			return err
+		}
+		offset += uint64(len(buf))
+	}
+	return nil
 }
 
-func CreateSourceFile(filePath string) SourceFile {
-	var sf SourceFile
-	var err error
+func CreateSourceFile(filePath string) (SourceFile, error) {
+	return CreateSourceFileWithParams(filePath, DefaultSyncParams())
+}
+
+// the file stays open for the search, File has to be closed after it
+func CreateSourceFileWithParams(filePath string, params SyncParams) (SourceFile, error) {
+	return CreateSourceFileFS(OSFS{}, filePath, params)
+}
 
-	sf.File, err = os.Open(filePath)
+// like CreateSourceFileWithParams for a file of fsys
+func CreateSourceFileFS(fsys FS, filePath string, params SyncParams) (SourceFile, error) {
+	file, err := fsys.OpenFile(filePath, os.O_RDONLY, 0)
 	if err != nil {
-		panic(err)
+		return SourceFile{}, err
 	}
 
-	stats, _ := sf.File.Stat()
-	sf.FileSize = uint64(stats.Size())
-
-	sf.reader = bufio.NewReader(sf.File)
-	n, _ := sf.reader.Read(sf.slidingWin.buffer[:])
-	sf.slidingWin.readBytes = uint64(n)
-	sf.slidingWin.cap = uint64(n)
+	stats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return SourceFile{}, err
+	}
 
-	sf.slidingWin.checkSum, sf.slidingWin.a_sum, sf.slidingWin.b_sum = NewCheckSum(sf.slidingWin.buffer[:CHUNK_SIZE])
-	sf.slidingWin.l_idx = CHUNK_SIZE - 1
-	return sf
+	sf, err := NewSourceFileAt(file, stats.Size(), params)
+	if err != nil {
+		file.Close()
+		return sf, err
+	}
+	sf.File = file
+	return sf, nil
 }
-func (rf *RemoteFile) WriteSyncedFile(response *Response, filePath string, replace bool) error {
-	if rf.FilePath == filePath {
-		filePath += ".tmp"
+
+// source of size bytes with random access, like a local file or a buffer
+func NewSourceFileAt(source io.ReaderAt, size int64, params SyncParams) (SourceFile, error) {
+	var holes []hole
+	if file, ok := source.(*os.File); ok {
+		holes = findHoles(file, uint64(size))
 	}
 
-	syncedFile, err := os.Create(filePath)
-	CheckErr(err)
-	rf.File, err = os.Open(rf.FilePath)
-	CheckErr(err)
+	sf, err := newSourceFile(&holeReader{file: source, holes: holes, size: uint64(size)}, params)
+	sf.source = source
+	sf.FileSize = uint64(size)
+	sf.holes = holes
+	return sf, err
+}
 
-	defer rf.File.Close()
-	defer syncedFile.Close()
-
-	for idx := range *response {
-		var responsePack *ResponsePacket = &((*response)[idx])
-		switch responsePack.BlockType {
-		case A_BLOCK:
-			syncedFile.Write(responsePack.Data)
-		case B_BLOCK:
-			chunkIdx := binary.LittleEndian.Uint64(responsePack.Data)
-			chunk := &rf.ChunkList[chunkIdx]
-			_, err := rf.File.Seek(int64(chunk.Offset), 0)
-
-			CheckErr(err)
-
-			buf := make([]byte, CHUNK_SIZE)
-			n, _ := rf.File.Read(buf)
-			if n != CHUNK_SIZE {
-				panic(n)
-			}
-
-			syncedFile.Write(buf)
-		}
+// source that is read once from start to end, like stdin or an HTTP body.
+// The search then runs on a single goroutine and basis compression can not be used
+func NewSourceFile(source io.Reader, params SyncParams) (SourceFile, error) {
+	return newSourceFile(source, params)
+}
+
+func newSourceFile(r io.Reader, params SyncParams) (SourceFile, error) {
+	var sf SourceFile
+
+	sf.Params = params
+	sf.slidingWin = NewSlidingWindow(params.BlockSize)
+	sf.slidingWin.rolling = params.Rolling
+
+	sf.reader = bufio.NewReader(r)
+	if params.Chunking == CHUNKING_CDC {
+		sf.chunker = NewCDCChunker(sf.reader, params.BlockSize)
+		return sf, nil
 	}
-	if replace {
-		os.Remove(rf.FilePath)
-		os.Rename(filePath, rf.FilePath)
+
+	// bufio can return short reads, the window needs a full buffer
+	n, err := io.ReadFull(sf.reader, sf.slidingWin.buffer[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return sf, err
 	}
-	return nil
+	sf.slidingWin.readBytes = uint64(n)
+	sf.slidingWin.cap = uint64(n)
+
+	sf.slidingWin.checkSum, sf.slidingWin.a_sum, sf.slidingWin.b_sum = params.Rolling.Sum(sf.slidingWin.buffer[:params.BlockSize])
+	return sf, nil
 }
 
 func (rf RemoteFile) String() string {
@@ -167,24 +342,29 @@ func (rf RemoteFile) String() string {
 
 func (sf SourceFile) String() string {
 	return fmt.Sprintf(
-		"filesize : %v \n ",
-		sf.FileSize,
+		"filesize : %v \n "+
+			"%v",
+		sf.FileSize, sf.Params,
 	)
 }
 
+func (sf *SourceFile) BlockSize() uint64 {
+	return sf.slidingWin.blockSize
+}
+
 // returns io.EOF if i cannot read anymore
-// my buffer is 4 * CHUNK_SIZE so i need to read 3 * CHUNK_SIZE
-// reads next 3 * CHUNK_SIZE bytes from file and resets k and l
+// my buffer is 4 * block size so i need to read 3 * block size
+// reads next 3 * block size bytes from file and resets k and l
 func (sf *SourceFile) Read(resetWindowBounds bool) (int, error) {
-	var newBuf [4 * CHUNK_SIZE]byte
+	newBuf := make([]byte, len(sf.slidingWin.buffer))
 	copy(newBuf[:], sf.slidingWin.buffer[sf.slidingWin.k_idx:sf.slidingWin.cap])
 	dif := sf.slidingWin.cap - sf.slidingWin.k_idx
-	n, err := sf.reader.Read(newBuf[dif:])
+	n, err := io.ReadFull(sf.reader, newBuf[dif:])
 	sf.slidingWin.buffer = newBuf
 	sf.slidingWin.readBytes += uint64(n)
 	sf.slidingWin.cap = uint64(n) + dif
 	if resetWindowBounds {
-		sf.slidingWin.l_idx = CHUNK_SIZE - 1
+		sf.slidingWin.l_idx = sf.slidingWin.blockSize - 1
 		sf.slidingWin.k_idx = 0
 	}
 	return n, err
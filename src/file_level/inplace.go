@@ -0,0 +1,55 @@
+package file_level
+
+import (
+	"errors"
+	"os"
+	"sort"
+)
+
+var (
+	ErrInPlaceOrder = errors.New("in place copy from basis data that was already overwritten")
+)
+
+// in place the receiver overwrites its basis while it writes, so only chunks
+// starting at or after the output position are still intact. The output
+// position of a match is its position in the source. Chunks already in
+// the right place cost nothing, the others are copied towards the start
+// of the file, which never overwrites data a later copy needs
+func (ex *RsyncExchange) inPlaceMatch(chunk *Chunk, pos uint64) *Chunk {
+	if !ex.InPlace || chunk.Offset >= pos {
+		return chunk
+	}
+
+	// identical chunks are indexed once, a later copy can still be intact
+	copies := ex.copies[chunk]
+	idx := sort.Search(len(copies), func(idx int) bool {
+		return copies[idx].Offset >= pos
+	})
+	if idx < len(copies) {
+		return copies[idx]
+	}
+	return nil
+}
+
+// updates the remote file itself instead of writing a new one, for files
+// that do not fit twice on their volume. The delta has to come from a
+// search with InPlace set and can not use basis compression.
+// There is no going back, an update that fails half way leaves the file
+// partly rewritten
+func (rf *RemoteFile) NewInPlaceWriter() (*SyncedFileWriter, error) {
+	file, err := openBasis(OrOS(rf.fs), rf.FilePath, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyncedFileWriter{
+		remoteFile: rf,
+		basis:      file,
+		basisFile:  file,
+		out:        file,
+		syncedFile: file,
+		fs:         OrOS(rf.fs),
+		filePath:   rf.FilePath,
+		inPlace:    true,
+	}, nil
+}
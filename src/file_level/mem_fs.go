@@ -0,0 +1,385 @@
+package file_level
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// a file system that only lives in memory, for tests and for services that
+// never touch the disk. Names are slash separated and relative ones start
+// at the root. Permissions are kept but not enforced, files have no holes
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{
+		"/": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+func cleanMemPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// the directory that holds name has to exist
+func (mfs *MemFS) parentDir(op, name string) error {
+	parent, ok := mfs.nodes[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (mfs *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	clean := cleanMemPath(name)
+	node, ok := mfs.nodes[clean]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := mfs.parentDir("open", clean); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		mfs.nodes[clean] = node
+	case flag&os.O_TRUNC != 0:
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{fs: mfs, node: node, name: name, flag: flag}, nil
+}
+
+func (mfs *MemFS) Stat(name string) (fs.FileInfo, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	clean := cleanMemPath(name)
+	node, ok := mfs.nodes[clean]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.info(path.Base(clean)), nil
+}
+
+// open files keep the data they had, like on unix
+func (mfs *MemFS) Rename(oldpath, newpath string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	oldClean, newClean := cleanMemPath(oldpath), cleanMemPath(newpath)
+	node, ok := mfs.nodes[oldClean]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := mfs.parentDir("rename", newClean); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err.(*fs.PathError).Err}
+	}
+	if oldClean == newClean {
+		return nil
+	}
+	if old, ok := mfs.nodes[newClean]; ok && old.mode.IsDir() != node.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	if node.mode.IsDir() && strings.HasPrefix(newClean, oldClean+"/") {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+
+	delete(mfs.nodes, oldClean)
+	mfs.nodes[newClean] = node
+	if node.mode.IsDir() {
+		// the whole subtree moves with the directory
+		for name, child := range mfs.nodes {
+			if strings.HasPrefix(name, oldClean+"/") {
+				delete(mfs.nodes, name)
+				mfs.nodes[newClean+strings.TrimPrefix(name, oldClean)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (mfs *MemFS) Remove(name string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	clean := cleanMemPath(name)
+	node, ok := mfs.nodes[clean]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if clean == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if node.mode.IsDir() {
+		for other := range mfs.nodes {
+			if strings.HasPrefix(other, clean+"/") {
+				return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	delete(mfs.nodes, clean)
+	return nil
+}
+
+func (mfs *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	clean := cleanMemPath(name)
+	// parents first, the root always exists
+	var missing []string
+	for dir := clean; dir != "/"; dir = path.Dir(dir) {
+		node, ok := mfs.nodes[dir]
+		if ok {
+			if !node.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for idx := len(missing) - 1; idx >= 0; idx-- {
+		mfs.nodes[missing[idx]] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+// names of the entries of the directory name, sorted
+func (mfs *MemFS) ReadDir(name string) ([]string, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	clean := cleanMemPath(name)
+	if node, ok := mfs.nodes[clean]; !ok || !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var names []string
+	for other := range mfs.nodes {
+		if other != "/" && other != clean && path.Dir(other) == clean {
+			names = append(names, path.Base(other))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (node *memNode) info(name string) fs.FileInfo {
+	return memFileInfo{name, int64(len(node.data)), node.mode, node.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) Mode() fs.FileMode  { return info.mode }
+func (info memFileInfo) ModTime() time.Time { return info.modTime }
+func (info memFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info memFileInfo) Sys() any           { return nil }
+
+// an open file of a MemFS, every access takes the lock of the file system
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+// checks the file can be used for op, the caller holds the lock
+func (file *memFile) check(op string, write bool) error {
+	switch {
+	case file.closed:
+		return &fs.PathError{Op: op, Path: file.name, Err: fs.ErrClosed}
+	case write && file.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &fs.PathError{Op: op, Path: file.name, Err: fs.ErrPermission}
+	case !write && file.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: file.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (file *memFile) Read(p []byte) (int, error) {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	n, err := file.readAt(p, file.offset)
+	file.offset += int64(n)
+	return n, err
+}
+
+func (file *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: file.name, Err: fs.ErrInvalid}
+	}
+	n, err := file.readAt(p, offset)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (file *memFile) readAt(p []byte, offset int64) (int, error) {
+	if err := file.check("read", false); err != nil {
+		return 0, err
+	}
+	if file.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: file.name, Err: syscall.EISDIR}
+	}
+	if offset >= int64(len(file.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, file.node.data[offset:]), nil
+}
+
+// writing past the end fills the gap with zeros
+func (file *memFile) Write(p []byte) (int, error) {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if err := file.check("write", true); err != nil {
+		return 0, err
+	}
+	if file.flag&os.O_APPEND != 0 {
+		file.offset = int64(len(file.node.data))
+	}
+	end := file.offset + int64(len(p))
+	file.node.resize(end, false)
+	copy(file.node.data[file.offset:], p)
+	file.offset = end
+	file.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (file *memFile) Seek(offset int64, whence int) (int64, error) {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return 0, &fs.PathError{Op: "seek", Path: file.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += int64(len(file.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: file.name, Err: fs.ErrInvalid}
+	}
+	file.offset = offset
+	return offset, nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if err := file.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: file.name, Err: fs.ErrInvalid}
+	}
+	file.node.resize(size, true)
+	file.node.modTime = time.Now()
+	return nil
+}
+
+// grows the data with zeros, or cuts it when shrink is set
+func (node *memNode) resize(size int64, shrink bool) {
+	switch {
+	case size > int64(cap(node.data)):
+		data := make([]byte, size, 2*size)
+		copy(data, node.data)
+		node.data = data
+	case size > int64(len(node.data)):
+		tail := node.data[len(node.data):size]
+		for idx := range tail {
+			tail[idx] = 0
+		}
+		node.data = node.data[:size]
+	case shrink:
+		node.data = node.data[:size]
+	}
+}
+
+func (file *memFile) Stat() (fs.FileInfo, error) {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return nil, &fs.PathError{Op: "stat", Path: file.name, Err: fs.ErrClosed}
+	}
+	return file.node.info(path.Base(cleanMemPath(file.name))), nil
+}
+
+// the data is only in memory, there is nothing to sync
+func (file *memFile) Sync() error {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return &fs.PathError{Op: "sync", Path: file.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (file *memFile) Chmod(mode fs.FileMode) error {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return &fs.PathError{Op: "chmod", Path: file.name, Err: fs.ErrClosed}
+	}
+	file.node.mode = file.node.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return &fs.PathError{Op: "close", Path: file.name, Err: fs.ErrClosed}
+	}
+	file.closed = true
+	return nil
+}
@@ -0,0 +1,166 @@
+package file_level
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// smallest block size accepted from the user or the other peer
+	MIN_BLOCK_SIZE = 64
+	// largest block size, same limit as rsync
+	MAX_BLOCK_SIZE = 1 << 17
+	// files smaller than AUTO_MIN_BLOCK_SIZE^2 bytes all use this size
+	AUTO_MIN_BLOCK_SIZE = 700
+)
+
+var (
+	ErrInvalidBlockSize  = errors.New("invalid block size")
+	ErrInvalidStrongSize = errors.New("invalid strong hash size")
+)
+
+// parameters that both sides of an exchange have to agree on
+// in CDC mode BlockSize is the average chunk size
+type SyncParams struct {
+	BlockSize     uint64
+	HashAlgorithm HashAlgorithm
+	Chunking      ChunkingMode
+
+	// only rdiff signatures set these, peers always use the defaults
+	Rolling RollingChecksum
+	// chunk strong hashes are cut to this many bytes, 0 keeps them whole
+	StrongSize int
+}
+
+func DefaultSyncParams() SyncParams {
+	return SyncParams{
+		BlockSize:     CHUNK_SIZE,
+		HashAlgorithm: HASH_SHA256,
+	}
+}
+
+// picks a block size for a file the same way rsync does,
+// roughly the square root of the file size rounded down to a multiple of 8
+func BlockSizeFor(fileSize uint64) uint64 {
+	if fileSize <= AUTO_MIN_BLOCK_SIZE*AUTO_MIN_BLOCK_SIZE {
+		return AUTO_MIN_BLOCK_SIZE
+	}
+
+	blockSize := isqrt(fileSize) &^ 7
+	if blockSize > MAX_BLOCK_SIZE {
+		blockSize = MAX_BLOCK_SIZE
+	}
+	return blockSize
+}
+
+func ValidateBlockSize(blockSize uint64) error {
+	if blockSize < MIN_BLOCK_SIZE || blockSize > MAX_BLOCK_SIZE {
+		return fmt.Errorf("%w: %d not in [%d, %d]", ErrInvalidBlockSize,
+			blockSize, MIN_BLOCK_SIZE, MAX_BLOCK_SIZE)
+	}
+	return nil
+}
+
+// MD4 is only known to read and write rdiff signatures, files and peers of
+// this tool can not use it
+func (params SyncParams) Validate() error {
+	if params.HashAlgorithm == HASH_MD4 {
+		return fmt.Errorf("%w: %v is only used for rdiff signatures", ErrUnknownHash, params.HashAlgorithm)
+	}
+	return params.validate()
+}
+
+func (params SyncParams) validate() error {
+	if _, err := params.newHasher(); err != nil {
+		return err
+	}
+	if err := params.Chunking.Validate(); err != nil {
+		return err
+	}
+	if err := params.Rolling.Validate(); err != nil {
+		return err
+	}
+	return ValidateBlockSize(params.BlockSize)
+}
+
+// parameters for another pass after the result of one did not match the
+// source, like the redo phase of rsync. Smaller blocks and a cryptographic
+// hash make it unlikely that the same false match happens again
+func (params SyncParams) Redo() SyncParams {
+	redo := params
+	if redo.BlockSize/2 >= MIN_BLOCK_SIZE {
+		redo.BlockSize /= 2
+	}
+	if redo.HashAlgorithm != HASH_SHA256 && redo.HashAlgorithm != HASH_BLAKE2B {
+		redo.HashAlgorithm = HASH_SHA256
+	}
+	return redo
+}
+
+// largest chunk the parameters allow
+func (params SyncParams) MaxChunkSize() uint64 {
+	if params.Chunking == CHUNKING_CDC {
+		return CDCMaxSize(params.BlockSize)
+	}
+	return params.BlockSize
+}
+
+// prev is the size of the chunk before, 0 for the first one. In fixed
+// mode only the last chunk can be shorter than a block, nothing follows it
+func (params SyncParams) validChunkSize(size, prev uint64) bool {
+	if size == 0 || size > params.MaxChunkSize() {
+		return false
+	}
+	return params.Chunking == CHUNKING_CDC || prev == 0 || prev == params.BlockSize
+}
+
+// hashes chunks with StrongSize bytes, whole files keep the full hash
+func (params SyncParams) newHasher() (StrongHasher, error) {
+	hasher, err := params.HashAlgorithm.Hasher()
+	if err != nil || params.StrongSize == 0 {
+		return hasher, err
+	}
+	if params.StrongSize < 0 || params.StrongSize > hasher.Size() {
+		return nil, fmt.Errorf("%w: %d not in [1, %d]", ErrInvalidStrongSize,
+			params.StrongSize, hasher.Size())
+	}
+	return truncatedHasher{hasher, params.StrongSize}, nil
+}
+
+type truncatedHasher struct {
+	StrongHasher
+	size int
+}
+
+func (th truncatedHasher) Sum(data []byte) []byte {
+	return th.StrongHasher.Sum(data)[:th.size]
+}
+
+func (th truncatedHasher) Size() int {
+	return th.size
+}
+
+// integer square root using newton's method
+func isqrt(n uint64) uint64 {
+	if n < 2 {
+		return n
+	}
+
+	x := n
+	y := (x + 1) / 2
+	for y < x {
+		x = y
+		y = (x + n/x) / 2
+	}
+	return x
+}
+
+func (params SyncParams) String() string {
+	return fmt.Sprintf(
+		"block size : %v \n "+
+			"hash       : %v \n "+
+			"chunking   : %v \n "+
+			"rolling    : %v \n ",
+		params.BlockSize, params.HashAlgorithm, params.Chunking, params.Rolling,
+	)
+}
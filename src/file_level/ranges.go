@@ -0,0 +1,138 @@
+package file_level
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// merges B_BLOCK packets of consecutive chunks into R_BLOCK packets,
+// an unchanged region of the file becomes a single packet.
+// Contiguous S_BLOCK copies are merged the same way
+type rangeSink struct {
+	sink PacketSink
+	// reports whether chunk idx holds the same data as chunk next, a match
+	// of a chunk with identical copies then still continues the run
+	same func(idx, next uint64) bool
+
+	pending bool
+	first   uint64
+	last    uint64
+
+	selfPending bool
+	selfOffset  uint64
+	selfSize    uint64
+}
+
+func newRangeSink(sink PacketSink, same func(idx, next uint64) bool) *rangeSink {
+	return &rangeSink{sink: sink, same: same}
+}
+
+func (rs *rangeSink) WritePacket(packet ResponsePacket) error {
+	switch packet.BlockType {
+	case B_BLOCK:
+		idx := binary.LittleEndian.Uint64(packet.Data)
+		if rs.pending && (idx == rs.last+1 || rs.same != nil && rs.same(idx, rs.last+1)) {
+			rs.last++
+			return nil
+		}
+		if err := rs.Flush(); err != nil {
+			return err
+		}
+		rs.pending, rs.first, rs.last = true, idx, idx
+		return nil
+	case S_BLOCK:
+		offset, size, err := packet.SelfRange()
+		if err != nil {
+			return err
+		}
+		if rs.selfPending && offset == rs.selfOffset+rs.selfSize {
+			rs.selfSize += size
+			return nil
+		}
+		if err := rs.Flush(); err != nil {
+			return err
+		}
+		rs.selfPending, rs.selfOffset, rs.selfSize = true, offset, size
+		return nil
+	}
+
+	if err := rs.Flush(); err != nil {
+		return err
+	}
+	return rs.sink.WritePacket(packet)
+}
+
+// sends the run that is still open, a single chunk as a B_BLOCK
+func (rs *rangeSink) Flush() error {
+	if rs.selfPending {
+		rs.selfPending = false
+		return rs.sink.WritePacket(newIndexPacket(S_BLOCK, rs.selfOffset, rs.selfSize))
+	}
+	if !rs.pending {
+		return nil
+	}
+	rs.pending = false
+
+	if rs.first == rs.last {
+		return rs.sink.WritePacket(newIndexPacket(B_BLOCK, rs.first))
+	}
+	return rs.sink.WritePacket(newIndexPacket(R_BLOCK, rs.first, rs.last))
+}
+
+func newIndexPacket(blockType ResponseType, indexes ...uint64) ResponsePacket {
+	data := make([]byte, 0, 8*len(indexes))
+	for _, idx := range indexes {
+		data = binary.LittleEndian.AppendUint64(data, idx)
+	}
+	return ResponsePacket{
+		blockType,
+		data,
+	}
+}
+
+// first and last index of the chunks a B_BLOCK or R_BLOCK packet copies
+func (packet ResponsePacket) ChunkRange() (first, last uint64, err error) {
+	switch {
+	case packet.BlockType == B_BLOCK && len(packet.Data) == 8:
+		first = binary.LittleEndian.Uint64(packet.Data)
+		return first, first, nil
+	case packet.BlockType == R_BLOCK && len(packet.Data) == 16:
+		first = binary.LittleEndian.Uint64(packet.Data)
+		last = binary.LittleEndian.Uint64(packet.Data[8:])
+		if first > last {
+			return 0, 0, fmt.Errorf("%w: range %d..%d", ErrChunkIndex, first, last)
+		}
+		return first, last, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: %v with %d bytes", ErrPacketType, packet.BlockType, len(packet.Data))
+	}
+}
+
+// output offset and size of the data an S_BLOCK packet copies
+func (packet ResponsePacket) SelfRange() (offset, size uint64, err error) {
+	if packet.BlockType != S_BLOCK || len(packet.Data) != 16 {
+		return 0, 0, fmt.Errorf("%w: %v with %d bytes", ErrPacketType, packet.BlockType, len(packet.Data))
+	}
+	return binary.LittleEndian.Uint64(packet.Data), binary.LittleEndian.Uint64(packet.Data[8:]), nil
+}
+
+// number of zeros an H_BLOCK packet stands for
+func (packet ResponsePacket) ZeroRun() (size uint64, err error) {
+	if packet.BlockType != H_BLOCK || len(packet.Data) != 8 {
+		return 0, fmt.Errorf("%w: %v with %d bytes", ErrPacketType, packet.BlockType, len(packet.Data))
+	}
+	return binary.LittleEndian.Uint64(packet.Data), nil
+}
+
+// the chunks from first to last are contiguous in the remote file
+func (rf *RemoteFile) chunkRange(first, last uint64) (offset, size uint64, err error) {
+	firstChunk, err := rf.chunkAt(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	lastChunk, err := rf.chunkAt(last)
+	if err != nil {
+		return 0, 0, err
+	}
+	return firstChunk.Offset, lastChunk.Offset + lastChunk.Size - firstChunk.Offset, nil
+}
@@ -0,0 +1,364 @@
+package file_level
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Signature and delta files of librsync, the formats rdiff reads and writes,
+// every integer is big endian
+// Source : https://librsync.github.io/page_formats.html
+//
+// a signature is
+//
+//	magic          uint32   one of the RDIFF_*_SIG_MAGIC values
+//	block length   uint32
+//	strong length  uint32   bytes kept of every strong hash
+//
+// followed by the weak checksum, uint32, and the strong hash of every block.
+// The size of the file is not stored, the last block is read back as a full
+// one, so a short last block of the basis is never matched
+//
+// a delta is the RDIFF_DELTA_MAGIC uint32 followed by commands, each one
+// an opcode and its arguments
+//
+//	RDIFF_OP_END                  end of the delta
+//	RDIFF_OP_LITERAL_1..64        that many bytes of literal data follow
+//	RDIFF_OP_LITERAL_N1..N8       literal length in 1, 2, 4 or 8 bytes, then the data
+//	RDIFF_OP_COPY_N1_N1..N8_N8    basis offset and length, each in 1, 2, 4 or 8 bytes
+const (
+	RDIFF_MD4_SIG_MAGIC       = 0x72730136
+	RDIFF_BLAKE2_SIG_MAGIC    = 0x72730137
+	RDIFF_RK_MD4_SIG_MAGIC    = 0x72730146
+	RDIFF_RK_BLAKE2_SIG_MAGIC = 0x72730147
+	RDIFF_DELTA_MAGIC         = 0x72730236
+
+	RDIFF_OP_END        = 0x00
+	RDIFF_OP_LITERAL_1  = 0x01
+	RDIFF_OP_LITERAL_64 = 0x40
+	RDIFF_OP_LITERAL_N1 = 0x41
+	RDIFF_OP_COPY_N1_N1 = 0x45
+	RDIFF_OP_COPY_N8_N8 = 0x54
+)
+
+var (
+	ErrRdiffMagic  = errors.New("not an rdiff file")
+	ErrRdiffParams = errors.New("parameters not supported by rdiff")
+)
+
+var rdiffSigMagics = map[uint32]SyncParams{
+	RDIFF_MD4_SIG_MAGIC:       {HashAlgorithm: HASH_MD4, Rolling: ROLLING_ROLLSUM},
+	RDIFF_BLAKE2_SIG_MAGIC:    {HashAlgorithm: HASH_BLAKE2B, Rolling: ROLLING_ROLLSUM},
+	RDIFF_RK_MD4_SIG_MAGIC:    {HashAlgorithm: HASH_MD4, Rolling: ROLLING_RABINKARP},
+	RDIFF_RK_BLAKE2_SIG_MAGIC: {HashAlgorithm: HASH_BLAKE2B, Rolling: ROLLING_RABINKARP},
+}
+
+// the signature magic of params, rdiff only knows fixed blocks
+// hashed with MD4 or BLAKE2b and the librsync rolling checksums
+func rdiffSigMagic(params SyncParams) (uint32, error) {
+	if params.Chunking == CHUNKING_FIXED {
+		for magic, sigParams := range rdiffSigMagics {
+			if sigParams.HashAlgorithm == params.HashAlgorithm && sigParams.Rolling == params.Rolling {
+				return magic, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: %v hash, %v rolling checksum, %v chunking", ErrRdiffParams,
+		params.HashAlgorithm, params.Rolling, params.Chunking)
+}
+
+// writes the signature of a basis in the format of rdiff signature
+type RdiffSignatureWriter struct {
+	writer     *bufio.Writer
+	strongSize int
+	count      uint64
+}
+
+// writes the header right away, Close has to be called after the last chunk
+func NewRdiffSignatureWriter(w io.Writer, params SyncParams) (*RdiffSignatureWriter, error) {
+	magic, err := rdiffSigMagic(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	hasher, err := params.newHasher()
+	if err != nil {
+		return nil, err
+	}
+
+	sigw := &RdiffSignatureWriter{writer: bufio.NewWriter(w), strongSize: hasher.Size()}
+	buf := binary.BigEndian.AppendUint32(nil, magic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(params.BlockSize))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(sigw.strongSize))
+	if _, err := sigw.writer.Write(buf); err != nil {
+		return nil, err
+	}
+	return sigw, nil
+}
+
+// chunks have to come in index order, the batches of CreateRemoteFileStream fit
+func (sigw *RdiffSignatureWriter) WriteChunks(chunks []Chunk) error {
+	for idx := range chunks {
+		chunk := &chunks[idx]
+		if chunk.Index != sigw.count || len(chunk.StrongHash) != sigw.strongSize {
+			return fmt.Errorf("%w: chunk %d with a %d byte hash after %d chunks",
+				ErrCorruptSignature, chunk.Index, len(chunk.StrongHash), sigw.count)
+		}
+
+		buf := binary.BigEndian.AppendUint32(nil, uint32(chunk.CheckSum))
+		buf = append(buf, chunk.StrongHash...)
+		if _, err := sigw.writer.Write(buf); err != nil {
+			return err
+		}
+		sigw.count++
+	}
+	return nil
+}
+
+// flushes, the underlying writer is not closed
+func (sigw *RdiffSignatureWriter) Close() error {
+	return sigw.writer.Flush()
+}
+
+// reads a signature written by rdiff signature, like ReadSignature
+// the returned remote file only has Params and the chunks. The size of the
+// basis is not in the signature, the last chunk has the block size until
+// SetRdiffBasisSize gives it the real one
+func ReadRdiffSignature(r io.Reader) (RemoteFile, error) {
+	var rf RemoteFile
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return rf, fmt.Errorf("%w: %v", ErrRdiffMagic, err)
+	}
+	params, ok := rdiffSigMagics[binary.BigEndian.Uint32(header)]
+	if !ok {
+		return rf, fmt.Errorf("%w: signature magic %#x", ErrRdiffMagic, binary.BigEndian.Uint32(header))
+	}
+	params.BlockSize = uint64(binary.BigEndian.Uint32(header[4:]))
+	params.StrongSize = int(binary.BigEndian.Uint32(header[8:]))
+	if params.StrongSize == 0 {
+		return rf, fmt.Errorf("%w: %d byte strong hashes", ErrCorruptSignature, params.StrongSize)
+	}
+	if err := params.validate(); err != nil {
+		return rf, fmt.Errorf("%w: %v", ErrCorruptSignature, err)
+	}
+	rf.Params = params
+
+	for {
+		record := make([]byte, 4+params.StrongSize)
+		n, err := io.ReadFull(reader, record)
+		if err == io.EOF {
+			return rf, nil
+		}
+		if err != nil {
+			return rf, fmt.Errorf("%w: %d bytes left after %d blocks: %v",
+				ErrCorruptSignature, n, rf.ChunkCount, err)
+		}
+
+		rf.ChunkList = append(rf.ChunkList, Chunk{
+			CheckSum:   CheckSum(binary.BigEndian.Uint32(record)),
+			StrongHash: record[4:],
+			Offset:     rf.ChunkCount * params.BlockSize,
+			Size:       params.BlockSize,
+			Index:      rf.ChunkCount,
+		})
+		rf.ChunkCount++
+	}
+}
+
+// sets the size of the last chunk of a signature of ReadRdiffSignature
+// from the size of its basis. A short last block can then be matched
+// at the end of the source and copies of it stay inside the basis
+func (rf *RemoteFile) SetRdiffBasisSize(size uint64) error {
+	if rf.ChunkCount == 0 {
+		if size != 0 {
+			return fmt.Errorf("%w: no blocks for a basis of %d bytes", ErrCorruptSignature, size)
+		}
+		return nil
+	}
+
+	last := &rf.ChunkList[rf.ChunkCount-1]
+	if size <= last.Offset || size > last.Offset+rf.Params.BlockSize {
+		return fmt.Errorf("%w: %d blocks of %d bytes for a basis of %d bytes",
+			ErrCorruptSignature, rf.ChunkCount, rf.Params.BlockSize, size)
+	}
+	last.Size = size - last.Offset
+	return nil
+}
+
+// writes the packets of a search as an rdiff delta, implements PacketSink.
+// rdiff only copies from the basis, compressed packets,
+// self references and zero runs are rejected
+type RdiffDeltaWriter struct {
+	writer *bufio.Writer
+	basis  *RemoteFile
+}
+
+// basis holds the chunks the packets refer to,
+// Close has to be called after the last packet
+func NewRdiffDeltaWriter(w io.Writer, basis *RemoteFile) (*RdiffDeltaWriter, error) {
+	dw := &RdiffDeltaWriter{writer: bufio.NewWriter(w), basis: basis}
+	if _, err := dw.writer.Write(binary.BigEndian.AppendUint32(nil, RDIFF_DELTA_MAGIC)); err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+func (dw *RdiffDeltaWriter) WritePacket(packet ResponsePacket) error {
+	switch packet.BlockType {
+	case A_BLOCK:
+		return dw.writeLiteral(packet.Data)
+	case B_BLOCK, R_BLOCK:
+		first, last, err := packet.ChunkRange()
+		if err != nil {
+			return err
+		}
+		offset, size, err := dw.basis.chunkRange(first, last)
+		if err != nil {
+			return err
+		}
+		return dw.writeCopy(offset, size)
+	default:
+		return fmt.Errorf("%w: %v", ErrPacketType, packet.BlockType)
+	}
+}
+
+func (dw *RdiffDeltaWriter) writeLiteral(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	if len(data) <= RDIFF_OP_LITERAL_64 {
+		buf = []byte{byte(RDIFF_OP_LITERAL_1 + len(data) - 1)}
+	} else {
+		width := rdiffIntWidth(uint64(len(data)))
+		buf = appendRdiffInt([]byte{byte(RDIFF_OP_LITERAL_N1 + width)}, uint64(len(data)), width)
+	}
+
+	if _, err := dw.writer.Write(buf); err != nil {
+		return err
+	}
+	_, err := dw.writer.Write(data)
+	return err
+}
+
+func (dw *RdiffDeltaWriter) writeCopy(offset, size uint64) error {
+	offsetWidth, sizeWidth := rdiffIntWidth(offset), rdiffIntWidth(size)
+	buf := []byte{byte(RDIFF_OP_COPY_N1_N1 + offsetWidth*4 + sizeWidth)}
+	buf = appendRdiffInt(buf, offset, offsetWidth)
+	buf = appendRdiffInt(buf, size, sizeWidth)
+	_, err := dw.writer.Write(buf)
+	return err
+}
+
+// writes the end command and flushes, the underlying writer is not closed
+func (dw *RdiffDeltaWriter) Close() error {
+	if err := dw.writer.WriteByte(RDIFF_OP_END); err != nil {
+		return err
+	}
+	return dw.writer.Flush()
+}
+
+// applies a delta made by rdiff delta to basis, like rdiff patch
+func PatchRdiff(basis io.ReaderAt, delta io.Reader, out io.Writer) error {
+	reader := bufio.NewReader(delta)
+	corrupt := func(err error) error {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%w: %v", ErrCorruptDelta, err)
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return fmt.Errorf("%w: %v", ErrRdiffMagic, err)
+	}
+	if binary.BigEndian.Uint32(magic) != RDIFF_DELTA_MAGIC {
+		return fmt.Errorf("%w: delta magic %#x", ErrRdiffMagic, binary.BigEndian.Uint32(magic))
+	}
+
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return corrupt(err)
+		}
+
+		switch {
+		case op == RDIFF_OP_END:
+			return nil
+		case op <= RDIFF_OP_LITERAL_64:
+			if _, err := io.CopyN(out, reader, int64(op-RDIFF_OP_LITERAL_1+1)); err != nil {
+				return corrupt(err)
+			}
+		case op < RDIFF_OP_COPY_N1_N1:
+			length, err := readRdiffInt(reader, int(op-RDIFF_OP_LITERAL_N1))
+			if err != nil {
+				return corrupt(err)
+			}
+			if _, err := io.CopyN(out, reader, int64(length)); err != nil {
+				return corrupt(err)
+			}
+		case op <= RDIFF_OP_COPY_N8_N8:
+			offset, err := readRdiffInt(reader, int(op-RDIFF_OP_COPY_N1_N1)/4)
+			if err != nil {
+				return corrupt(err)
+			}
+			size, err := readRdiffInt(reader, int(op-RDIFF_OP_COPY_N1_N1)%4)
+			if err != nil {
+				return corrupt(err)
+			}
+			if _, err := io.CopyN(out, io.NewSectionReader(basis, int64(offset), int64(size)), int64(size)); err != nil {
+				if err == io.EOF {
+					return fmt.Errorf("%w: copy of %d bytes at %d is past the end of the basis",
+						ErrCorruptDelta, size, offset)
+				}
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown command %#x", ErrCorruptDelta, op)
+		}
+	}
+}
+
+// index of the smallest of the 1, 2, 4 and 8 byte integers that holds val
+func rdiffIntWidth(val uint64) int {
+	switch {
+	case val <= 0xff:
+		return 0
+	case val <= 0xffff:
+		return 1
+	case val <= 0xffffffff:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func appendRdiffInt(buf []byte, val uint64, width int) []byte {
+	for shift := (8<<width - 8); shift >= 0; shift -= 8 {
+		buf = append(buf, byte(val>>shift))
+	}
+	return buf
+}
+
+func readRdiffInt(r io.Reader, width int) (uint64, error) {
+	buf := make([]byte, 1<<width)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+
+	var val uint64
+	for _, el := range buf {
+		val = val<<8 | uint64(el)
+	}
+	return val, nil
+}
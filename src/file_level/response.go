@@ -4,9 +4,20 @@ import "fmt"
 
 type ResponseType int
 
+// the values are written to delta files, new types only go at the end
 const (
 	B_BLOCK ResponseType = iota
 	A_BLOCK
+	// literal data compressed with deflate
+	Z_BLOCK
+	// literal data compressed with matched basis chunks as dictionary
+	D_BLOCK
+	// copy of the consecutive chunks from a first to a last index
+	R_BLOCK
+	// copy of data the output already holds, from an offset and a size
+	S_BLOCK
+	// run of zeros of a size, the receiver leaves a hole for it
+	H_BLOCK
 )
 
 type ResponsePacket struct {
@@ -16,6 +27,16 @@ type ResponsePacket struct {
 
 type Response []ResponsePacket
 
+// receives the packets of a delta one by one, in order
+type PacketSink interface {
+	WritePacket(packet ResponsePacket) error
+}
+
+func (response *Response) WritePacket(packet ResponsePacket) error {
+	*response = append(*response, packet)
+	return nil
+}
+
 func (packet ResponsePacket) String() string {
 	return fmt.Sprintf(
 		"Block Type : %v \n "+
@@ -41,6 +62,16 @@ func (resp ResponseType) String() string {
 	switch resp {
 	case A_BLOCK:
 		return "A_BLOCK"
+	case Z_BLOCK:
+		return "Z_BLOCK"
+	case D_BLOCK:
+		return "D_BLOCK"
+	case R_BLOCK:
+		return "R_BLOCK"
+	case S_BLOCK:
+		return "S_BLOCK"
+	case H_BLOCK:
+		return "H_BLOCK"
 	default:
 		return "B_BLOCK"
 	}
@@ -0,0 +1,93 @@
+package file_level
+
+import (
+	"errors"
+	"fmt"
+)
+
+// weak checksum of the sliding window, only rdiff signatures use
+// something else than the rsync one
+type RollingChecksum uint8
+
+// the zero value is the checksum every peer used so far
+const (
+	ROLLING_RSYNC RollingChecksum = iota
+	// rollsum of librsync, adler-32 with an offset added to every byte
+	ROLLING_ROLLSUM
+	// rabinkarp of librsync
+	ROLLING_RABINKARP
+)
+
+const (
+	ROLLSUM_CHAR_OFFSET = 31
+
+	RABINKARP_SEED = 1
+	RABINKARP_MULT = 0x08104225
+	// RABINKARP_MULT - RABINKARP_SEED, removes the seed of the byte leaving
+	RABINKARP_ADJ = 0x08104224
+)
+
+var (
+	ErrUnknownRolling = errors.New("unknown rolling checksum")
+)
+
+func (rc RollingChecksum) Validate() error {
+	if rc > ROLLING_RABINKARP {
+		return fmt.Errorf("%w: %d", ErrUnknownRolling, rc)
+	}
+	return nil
+}
+
+// checksum of data, a_sum and b_sum are the state Roll needs
+func (rc RollingChecksum) Sum(data []byte) (sum CheckSum, a_sum, b_sum uint32) {
+	switch rc {
+	case ROLLING_ROLLSUM:
+		for _, el := range data {
+			a_sum += uint32(el) + ROLLSUM_CHAR_OFFSET
+			b_sum += a_sum
+		}
+		return rollsumDigest(a_sum, b_sum), a_sum, b_sum
+	case ROLLING_RABINKARP:
+		// a_sum is the hash, b_sum RABINKARP_MULT to the window size
+		a_sum, b_sum = RABINKARP_SEED, 1
+		for _, el := range data {
+			a_sum = a_sum*RABINKARP_MULT + uint32(el)
+			b_sum *= RABINKARP_MULT
+		}
+		return CheckSum(a_sum), a_sum, b_sum
+	default:
+		return NewCheckSum(data)
+	}
+}
+
+// slides the checksum of a window of size bytes by one byte, see RollCheckSum
+func (rc RollingChecksum) Roll(a_sum, b_sum uint32, size uint64, out, in byte) (sum CheckSum, new_a, new_b uint32) {
+	switch rc {
+	case ROLLING_ROLLSUM:
+		new_a = a_sum + uint32(in) - uint32(out)
+		new_b = b_sum + new_a - uint32(size)*(uint32(out)+ROLLSUM_CHAR_OFFSET)
+		return rollsumDigest(new_a, new_b), new_a, new_b
+	case ROLLING_RABINKARP:
+		new_a = a_sum*RABINKARP_MULT + uint32(in) - b_sum*(uint32(out)+RABINKARP_ADJ)
+		return CheckSum(new_a), new_a, b_sum
+	default:
+		return RollCheckSum(a_sum, b_sum, size, out, in)
+	}
+}
+
+func rollsumDigest(s1, s2 uint32) CheckSum {
+	return CheckSum(s2)<<16 | CheckSum(s1)&0xffff
+}
+
+var rollingNames = map[RollingChecksum]string{
+	ROLLING_RSYNC:     "rsync",
+	ROLLING_ROLLSUM:   "rollsum",
+	ROLLING_RABINKARP: "rabinkarp",
+}
+
+func (rc RollingChecksum) String() string {
+	if name, ok := rollingNames[rc]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", rc)
+}
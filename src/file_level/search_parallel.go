@@ -0,0 +1,287 @@
+package file_level
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+const (
+	// upper bound of the source bytes one worker searches at once
+	SEARCH_REGION_SIZE = 16 << 20
+)
+
+type regionMatch struct {
+	pos   uint64
+	chunk *Chunk
+}
+
+// windows starting in [start, end) searched by one worker as if the
+// sequential search had reached start without a pending match
+type searchRegion struct {
+	start uint64
+	end   uint64
+	// source bytes from start up to the last byte of the last window
+	data []byte
+
+	matches []regionMatch
+	// first position the search reached at or after end
+	exit uint64
+	err  error
+	done chan struct{}
+}
+
+// splits the source from start on into regions that are searched
+// concurrently against the read only hashmap. Matched chunks are never
+// removed, so the search from a position always makes the same choices,
+// which lets the merge resume a region from wherever the previous match
+// really ended. The packets are the same the sequential search produces.
+// Every remote chunk has to be known before the hashmap is shared, a
+// streaming search only hands over here once its stream is done
+func (ex *RsyncExchange) searchParallel(sink PacketSink, source io.ReaderAt, start, sourceSize uint64) error {
+	blockSize := ex.sourceFile.BlockSize()
+	var windowEnd uint64
+	if sourceSize >= blockSize {
+		windowEnd = sourceSize - blockSize + 1
+	}
+
+	regionSize := sourceSize / uint64(4*ex.Workers)
+	if regionSize < 16*blockSize {
+		regionSize = 16 * blockSize
+	}
+	if regionSize > SEARCH_REGION_SIZE {
+		regionSize = SEARCH_REGION_SIZE
+	}
+
+	work := make(chan *searchRegion)
+	// bounds the number of regions in memory
+	ordered := make(chan *searchRegion, 2*ex.Workers)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer close(work)
+		defer close(ordered)
+
+		for first := start; first < windowEnd; first += regionSize {
+			region := &searchRegion{
+				start: first,
+				end:   first + regionSize,
+				done:  make(chan struct{}),
+			}
+			if region.end > windowEnd {
+				region.end = windowEnd
+			}
+
+			for _, queue := range []chan *searchRegion{ordered, work} {
+				select {
+				case queue <- region:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	for idx := 0; idx < ex.Workers; idx++ {
+		go func() {
+			for region := range work {
+				region.data = make([]byte, region.end-region.start+blockSize-1)
+				if region.err = readFullAt(source, region.data, region.start); region.err == nil {
+					region.matches, region.exit = ex.scanRegion(region.data, region.start,
+						region.start, region.end, nil)
+				}
+				close(region.done)
+			}
+		}()
+	}
+
+	merge := regionMerge{ex: ex, sink: sink, source: source, cursor: start, literalStart: start}
+	for region := range ordered {
+		<-region.done
+		if region.err != nil {
+			return region.err
+		}
+		if err := merge.add(region); err != nil {
+			return err
+		}
+	}
+
+	return merge.finish(sourceSize)
+}
+
+// searches the windows starting in [from, to), data holds the source
+// from base on. stop is checked before every window so the search can hand
+// over to results that are already known
+func (ex *RsyncExchange) scanRegion(data []byte, base, from, to uint64,
+	stop func(pos uint64) bool) (matches []regionMatch, exit uint64) {
+
+	blockSize := ex.sourceFile.BlockSize()
+	rolling := ex.sourceFile.Params.Rolling
+	var checkSum CheckSum
+	var a_sum, b_sum uint32
+	valid := false
+
+	pos := from
+	for pos < to {
+		if stop != nil && stop(pos) {
+			return matches, pos
+		}
+
+		window := data[pos-base : pos-base+blockSize]
+		if !valid {
+			checkSum, a_sum, b_sum = rolling.Sum(window)
+			valid = true
+		}
+
+		if chunk := ex.lookup(checkSum, window, pos); chunk != nil {
+			matches = append(matches, regionMatch{pos, chunk})
+			pos += blockSize
+			valid = false
+			continue
+		}
+
+		if pos+1 < to {
+			checkSum, a_sum, b_sum = rolling.Roll(a_sum, b_sum, blockSize,
+				data[pos-base], data[pos-base+blockSize])
+		}
+		pos++
+	}
+	return matches, pos
+}
+
+// same as matchWindow but safe to call from several goroutines
+func (ex *RsyncExchange) lookup(checkSum CheckSum, window []byte, pos uint64) *Chunk {
+	res := ex.HashMap[checkSum]
+	if len(res) == 0 {
+		return nil
+	}
+
+	strongHash := ex.hasher.Sum(window)
+	for _, chunk := range res {
+		if bytes.Equal(chunk.StrongHash, strongHash) {
+			return ex.inPlaceMatch(chunk, pos)
+		}
+	}
+	return nil
+}
+
+// turns the per region results into packets in source order
+type regionMerge struct {
+	ex     *RsyncExchange
+	sink   PacketSink
+	source io.ReaderAt
+
+	// next window the sequential search would look at
+	cursor uint64
+	// first source byte that was not sent yet
+	literalStart uint64
+}
+
+func (m *regionMerge) add(region *searchRegion) error {
+	if m.cursor >= region.end {
+		// a match from an earlier region covers this one entirely
+		return nil
+	}
+
+	matches := region.matches
+	exit := region.exit
+	if m.cursor > region.start {
+		// the previous region ended with a match crossing into this one,
+		// search again from its real end until reaching a window
+		// the worker also looked at, from there on the results agree
+		resynced, resyncExit := m.ex.scanRegion(region.data, region.start, m.cursor, region.end,
+			region.visited)
+		if err := m.emitMatches(resynced); err != nil {
+			return err
+		}
+
+		if resyncExit >= region.end {
+			m.cursor = resyncExit
+			return nil
+		}
+
+		first := sort.Search(len(matches), func(idx int) bool {
+			return matches[idx].pos >= resyncExit
+		})
+		matches = matches[first:]
+	}
+
+	if err := m.emitMatches(matches); err != nil {
+		return err
+	}
+	m.cursor = exit
+	return nil
+}
+
+// whether the worker searched the window at pos, which is every position
+// except those inside one of its matches
+func (region *searchRegion) visited(pos uint64) bool {
+	idx := sort.Search(len(region.matches), func(idx int) bool {
+		return region.matches[idx].pos >= pos
+	})
+	if idx < len(region.matches) && region.matches[idx].pos == pos {
+		return true
+	}
+	if idx == 0 {
+		return true
+	}
+	prev := region.matches[idx-1]
+	return pos >= prev.pos+prev.chunk.Size
+}
+
+func (m *regionMerge) emitMatches(matches []regionMatch) error {
+	for _, match := range matches {
+		if err := m.emitLiteral(match.pos); err != nil {
+			return err
+		}
+		if err := m.sink.WritePacket(newBlockPacket(match.chunk)); err != nil {
+			return err
+		}
+		m.literalStart = match.pos + match.chunk.Size
+	}
+	return nil
+}
+
+// sends the source bytes up to end in packets of at most a block
+func (m *regionMerge) emitLiteral(end uint64) error {
+	blockSize := m.ex.sourceFile.BlockSize()
+	for m.literalStart < end {
+		dim := end - m.literalStart
+		if dim > blockSize {
+			dim = blockSize
+		}
+
+		data := make([]byte, dim)
+		if err := readFullAt(m.source, data, m.literalStart); err != nil {
+			return err
+		}
+		if err := m.sink.WritePacket(ResponsePacket{
+			A_BLOCK,
+			data,
+		}); err != nil {
+			return err
+		}
+		m.literalStart += dim
+	}
+	return nil
+}
+
+// the end of the source can still match the short last chunk, see emitTail
+func (m *regionMerge) finish(sourceSize uint64) error {
+	chunk := m.ex.tailChunk
+	if chunk != nil && chunk.Size <= sourceSize-m.literalStart {
+		window := make([]byte, chunk.Size)
+		if err := readFullAt(m.source, window, sourceSize-chunk.Size); err != nil {
+			return err
+		}
+
+		if checkSum, _, _ := m.ex.sourceFile.Params.Rolling.Sum(window); checkSum == chunk.CheckSum &&
+			bytes.Equal(m.ex.hasher.Sum(window), chunk.StrongHash) {
+			if match := m.ex.inPlaceMatch(chunk, sourceSize-chunk.Size); match != nil {
+				return m.emitMatches([]regionMatch{{sourceSize - chunk.Size, match}})
+			}
+		}
+	}
+	return m.emitLiteral(sourceSize)
+}
@@ -0,0 +1,73 @@
+package file_level
+
+import (
+	"bytes"
+)
+
+// literal data the search already sent, the receiver copies it back from
+// the part of the output it wrote, like the COPY instructions of xdelta
+type selfRef struct {
+	// offset in the source, the same as in the output
+	offset     uint64
+	size       uint64
+	strongHash []byte
+}
+
+func newSelfPacket(ref *selfRef) ResponsePacket {
+	return newIndexPacket(S_BLOCK, ref.offset, ref.size)
+}
+
+// indexes a full block of literal data that starts at offset in the source
+func (ex *RsyncExchange) indexLiteral(data []byte, offset uint64) {
+	if !ex.SelfRefs {
+		return
+	}
+	if ex.selfMap == nil {
+		ex.selfMap = make(map[CheckSum][]selfRef)
+	}
+
+	checkSum, _, _ := ex.sourceFile.Params.Rolling.Sum(data)
+	strongHash := ex.hasher.Sum(data)
+	for _, ref := range ex.selfMap[checkSum] {
+		if bytes.Equal(ref.strongHash, strongHash) {
+			// the first copy is as good as any other
+			return
+		}
+	}
+	ex.selfMap[checkSum] = append(ex.selfMap[checkSum], selfRef{offset, uint64(len(data)), strongHash})
+}
+
+// a literal block with the same content as the current window, if one was sent
+func (ex *RsyncExchange) matchSelf() *selfRef {
+	refs := ex.selfMap[ex.sourceFile.slidingWin.checkSum]
+	if len(refs) == 0 {
+		return nil
+	}
+
+	strongHash := ex.hasher.Sum(ex.sourceFile.slidingWin.GetBuffer())
+	for idx := range refs {
+		if bytes.Equal(refs[idx].strongHash, strongHash) {
+			return &refs[idx]
+		}
+	}
+	return nil
+}
+
+func (ex *RsyncExchange) indexLiteralCDC(strongHash string, data []byte, offset uint64) {
+	if !ex.SelfRefs {
+		return
+	}
+	if ex.selfStrong == nil {
+		ex.selfStrong = make(map[string]selfRef)
+	}
+	if _, ok := ex.selfStrong[strongHash]; !ok {
+		ex.selfStrong[strongHash] = selfRef{offset, uint64(len(data)), []byte(strongHash)}
+	}
+}
+
+func (ex *RsyncExchange) matchSelfCDC(strongHash string, data []byte) *selfRef {
+	if ref, ok := ex.selfStrong[strongHash]; ok && ref.size == uint64(len(data)) {
+		return &ref
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package file_level
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Signature file format, every integer is little endian
+//
+//	magic          4 bytes  "SYSF"
+//	version        uint16   SIGNATURE_VERSION
+//	block size     uint64
+//	hash algorithm uint8    HashAlgorithm value
+//	chunking       uint8    ChunkingMode value
+//
+// followed by one record per chunk, in index order
+//
+//	size           uvarint, never 0
+//	checksum       uint32   rolling checksum, 0 in CDC mode
+//	strong hash    the size of the hash algorithm
+//
+// and an end record, a 0 size followed by the uvarint number of chunks.
+// Offsets and indexes follow from the order of the chunks
+const (
+	SIGNATURE_MAGIC   = "SYSF"
+	SIGNATURE_VERSION = 1
+)
+
+var (
+	ErrSignatureMagic   = errors.New("not a signature file")
+	ErrSignatureVersion = errors.New("unsupported signature file version")
+	ErrCorruptSignature = errors.New("corrupt signature file")
+)
+
+type SignatureWriter struct {
+	writer *bufio.Writer
+	params SyncParams
+	count  uint64
+}
+
+// writes the header right away, Close has to be called after the last chunk
+func NewSignatureWriter(w io.Writer, params SyncParams) (*SignatureWriter, error) {
+	buf := []byte(SIGNATURE_MAGIC)
+	buf = binary.LittleEndian.AppendUint16(buf, SIGNATURE_VERSION)
+	buf = binary.LittleEndian.AppendUint64(buf, params.BlockSize)
+	buf = append(buf, byte(params.HashAlgorithm), byte(params.Chunking))
+
+	sigw := &SignatureWriter{writer: bufio.NewWriter(w), params: params}
+	if _, err := sigw.writer.Write(buf); err != nil {
+		return nil, err
+	}
+	return sigw, nil
+}
+
+// chunks have to come in index order, the batches of CreateRemoteFileStream fit
+func (sigw *SignatureWriter) WriteChunks(chunks []Chunk) error {
+	for idx := range chunks {
+		chunk := &chunks[idx]
+		if chunk.Index != sigw.count || chunk.Size == 0 {
+			return fmt.Errorf("%w: chunk %d of %d bytes after %d chunks",
+				ErrCorruptSignature, chunk.Index, chunk.Size, sigw.count)
+		}
+
+		buf := binary.AppendUvarint(nil, chunk.Size)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(chunk.CheckSum))
+		buf = append(buf, chunk.StrongHash...)
+		if _, err := sigw.writer.Write(buf); err != nil {
+			return err
+		}
+		sigw.count++
+	}
+	return nil
+}
+
+// writes the end record and flushes, the underlying writer is not closed
+func (sigw *SignatureWriter) Close() error {
+	if _, err := sigw.writer.Write(binary.AppendUvarint([]byte{0}, sigw.count)); err != nil {
+		return err
+	}
+	return sigw.writer.Flush()
+}
+
+// the returned remote file only has Params and the chunks,
+// there is no basis file behind it
+func ReadSignature(r io.Reader) (RemoteFile, error) {
+	var rf RemoteFile
+	reader := bufio.NewReader(r)
+
+	fixed := make([]byte, len(SIGNATURE_MAGIC)+2+8+1+1)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return rf, fmt.Errorf("%w: %v", ErrSignatureMagic, err)
+	}
+	if string(fixed[:len(SIGNATURE_MAGIC)]) != SIGNATURE_MAGIC {
+		return rf, ErrSignatureMagic
+	}
+	fixed = fixed[len(SIGNATURE_MAGIC):]
+
+	if version := binary.LittleEndian.Uint16(fixed); version != SIGNATURE_VERSION {
+		return rf, fmt.Errorf("%w: %d", ErrSignatureVersion, version)
+	}
+	rf.Params = SyncParams{
+		BlockSize:     binary.LittleEndian.Uint64(fixed[2:]),
+		HashAlgorithm: HashAlgorithm(fixed[10]),
+		Chunking:      ChunkingMode(fixed[11]),
+	}
+	if err := rf.Params.Validate(); err != nil {
+		return rf, fmt.Errorf("%w: %v", ErrCorruptSignature, err)
+	}
+	hasher, err := rf.Params.newHasher()
+	if err != nil {
+		return rf, fmt.Errorf("%w: %v", ErrCorruptSignature, err)
+	}
+	hashSize := hasher.Size()
+
+	corrupt := func(err error) error {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%w: %v", ErrCorruptSignature, err)
+	}
+
+	var offset, prev uint64
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return rf, corrupt(err)
+		}
+
+		if size == 0 {
+			count, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return rf, corrupt(err)
+			}
+			if count != rf.ChunkCount {
+				return rf, fmt.Errorf("%w: %d chunks, the end record says %d",
+					ErrCorruptSignature, rf.ChunkCount, count)
+			}
+			return rf, nil
+		}
+		if !rf.Params.validChunkSize(size, prev) {
+			return rf, fmt.Errorf("%w: chunk of %d bytes", ErrCorruptSignature, size)
+		}
+		prev = size
+
+		record := make([]byte, 4+hashSize)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return rf, corrupt(err)
+		}
+
+		rf.ChunkList = append(rf.ChunkList, Chunk{
+			CheckSum:   CheckSum(binary.LittleEndian.Uint32(record)),
+			StrongHash: record[4:],
+			Offset:     offset,
+			Size:       size,
+			Index:      rf.ChunkCount,
+		})
+		offset += size
+		rf.ChunkCount++
+	}
+}
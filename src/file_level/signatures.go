@@ -0,0 +1,194 @@
+package file_level
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"runtime"
+)
+
+// a region of consecutive chunks hashed by one worker
+type signatureJob struct {
+	chunks []Chunk
+	err    error
+	done   chan struct{}
+}
+
+// number of workers used when the user does not pick one
+func DefaultWorkers() int {
+	return runtime.NumCPU()
+}
+
+// splits the file into regions of SIGNATURE_BATCH_SIZE chunks that are read
+// with ReadAt and hashed by a pool of workers. Regions are collected in order,
+// so the chunk list and the batches handed to sendBatch keep the Index order
+func (rf *RemoteFile) chunkParallel(basis io.ReaderAt, size uint64, hasher StrongHasher, workers int, sendBatch func([]Chunk) error) error {
+	work := make(chan *signatureJob)
+	// bounds the number of regions in flight
+	ordered := make(chan *signatureJob, 2*workers)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// only read once ordered is closed
+	var cutErr error
+	go func() {
+		defer close(work)
+		defer close(ordered)
+
+		queue := func(job *signatureJob) bool {
+			select {
+			case ordered <- job:
+			case <-quit:
+				return false
+			}
+			select {
+			case work <- job:
+			case <-quit:
+				return false
+			}
+			return true
+		}
+
+		if rf.Params.Chunking == CHUNKING_CDC {
+			cutErr = rf.cutCDCRegions(basis, size, queue)
+		} else {
+			rf.cutFixedRegions(size, queue)
+		}
+	}()
+
+	for idx := 0; idx < workers; idx++ {
+		go func() {
+			buf := make([]byte, rf.Params.MaxChunkSize())
+			for job := range work {
+				job.err = rf.hashRegion(basis, job.chunks, buf, hasher)
+				close(job.done)
+			}
+		}()
+	}
+
+	for job := range ordered {
+		<-job.done
+		if job.err != nil {
+			return job.err
+		}
+
+		rf.ChunkList = append(rf.ChunkList, job.chunks...)
+		rf.ChunkCount += uint64(len(job.chunks))
+		if sendBatch != nil {
+			if err := sendBatch(job.chunks); err != nil {
+				return err
+			}
+		}
+	}
+	return cutErr
+}
+
+func newSignatureJob(capacity int) *signatureJob {
+	return &signatureJob{
+		chunks: make([]Chunk, 0, capacity),
+		done:   make(chan struct{}),
+	}
+}
+
+func (rf *RemoteFile) cutFixedRegions(fileSize uint64, queue func(*signatureJob) bool) {
+	blockSize := rf.Params.BlockSize
+	chunkCount := (fileSize + blockSize - 1) / blockSize
+
+	for first := uint64(0); first < chunkCount; first += SIGNATURE_BATCH_SIZE {
+		job := newSignatureJob(SIGNATURE_BATCH_SIZE)
+		for idx := first; idx < first+SIGNATURE_BATCH_SIZE && idx < chunkCount; idx++ {
+			size := blockSize
+			if rest := fileSize - idx*blockSize; rest < blockSize {
+				size = rest
+			}
+			job.chunks = append(job.chunks, Chunk{
+				Offset: idx * blockSize,
+				Size:   size,
+				Index:  idx,
+			})
+		}
+		if !queue(job) {
+			return
+		}
+	}
+}
+
+// chunk boundaries depend on the content before them, so they are found
+// sequentially with the cheap gear hash and only the hashing is parallel.
+// A read error ends the regions, nothing after it would read the file again
+func (rf *RemoteFile) cutCDCRegions(basis io.ReaderAt, size uint64, queue func(*signatureJob) bool) error {
+	chunker := NewCDCChunker(bufio.NewReader(io.NewSectionReader(basis, 0, int64(size))), rf.Params.BlockSize)
+
+	var offset, idx uint64
+	job := newSignatureJob(SIGNATURE_BATCH_SIZE)
+	for {
+		buf, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		job.chunks = append(job.chunks, Chunk{
+			Offset: offset,
+			Size:   uint64(len(buf)),
+			Index:  idx,
+		})
+		offset += uint64(len(buf))
+		idx++
+
+		if len(job.chunks) == SIGNATURE_BATCH_SIZE {
+			if !queue(job) {
+				return nil
+			}
+			job = newSignatureJob(SIGNATURE_BATCH_SIZE)
+		}
+	}
+
+	if len(job.chunks) > 0 {
+		queue(job)
+	}
+	return nil
+}
+
+func (rf *RemoteFile) hashRegion(basis io.ReaderAt, chunks []Chunk, buf []byte, hasher StrongHasher) error {
+	for idx := range chunks {
+		chunk := &chunks[idx]
+		data := buf[:chunk.Size]
+		if inHole(rf.holes, chunk.Offset, chunk.Size) {
+			for idx := range data {
+				data[idx] = 0
+			}
+		} else if err := readFullAt(basis, data, chunk.Offset); err != nil {
+			return err
+		}
+		chunk.CheckSum, chunk.StrongHash = rf.sumChunk(data, chunk.Offset, hasher)
+	}
+	return nil
+}
+
+// weak and strong sums of the chunk at offset, a full block in a hole
+// is not hashed again. CDC chunks are matched by strong hash only
+func (rf *RemoteFile) sumChunk(data []byte, offset uint64, hasher StrongHasher) (CheckSum, []byte) {
+	if rf.zeroChunk != nil && uint64(len(data)) == rf.zeroChunk.Size && inHole(rf.holes, offset, rf.zeroChunk.Size) {
+		return rf.zeroChunk.CheckSum, rf.zeroChunk.StrongHash
+	}
+	if rf.Params.Chunking == CHUNKING_CDC {
+		return 0, hasher.Sum(data)
+	}
+	checkSum, _, _ := rf.Params.Rolling.Sum(data)
+	return checkSum, hasher.Sum(data)
+}
+
+// holes of the basis are read as zeros, the full blocks in them all have the same sums
+func (rf *RemoteFile) findHoles(file *os.File, fileSize uint64, hasher StrongHasher) {
+	rf.holes = findHoles(file, fileSize)
+	if len(rf.holes) == 0 || rf.Params.Chunking == CHUNKING_CDC {
+		return
+	}
+
+	zeros := make([]byte, rf.Params.BlockSize)
+	checkSum, _, _ := rf.Params.Rolling.Sum(zeros)
+	rf.zeroChunk = &Chunk{CheckSum: checkSum, StrongHash: hasher.Sum(zeros), Size: rf.Params.BlockSize}
+}
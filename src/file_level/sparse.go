@@ -0,0 +1,264 @@
+package file_level
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+)
+
+// shortest run of zeros inside a literal that is sent as an H_BLOCK,
+// shorter runs cost more as a packet than as data
+const SPARSE_MIN_RUN = 1024
+
+// turns runs of zeros into H_BLOCK packets, from literal data and from matched
+// chunks that hold nothing but zeros. Consecutive runs become one packet,
+// Flush sends the run that is still open
+type sparseSink struct {
+	sink PacketSink
+
+	// nil when no chunk is matched, like for a whole file
+	chunkAt func(idx uint64) (*Chunk, error)
+	hasher  StrongHasher
+	// strong hash of a chunk of zeros, by chunk size
+	zeroHashes map[uint64][]byte
+
+	zeros uint64
+}
+
+func newSparseSink(sink PacketSink, chunkAt func(idx uint64) (*Chunk, error), hasher StrongHasher) *sparseSink {
+	return &sparseSink{
+		sink:       sink,
+		chunkAt:    chunkAt,
+		hasher:     hasher,
+		zeroHashes: make(map[uint64][]byte),
+	}
+}
+
+func (ss *sparseSink) WritePacket(packet ResponsePacket) error {
+	switch packet.BlockType {
+	case A_BLOCK:
+		return ss.writeLiteral(packet.Data)
+	case B_BLOCK, R_BLOCK:
+		if ss.chunkAt != nil {
+			return ss.writeRange(packet)
+		}
+	case H_BLOCK:
+		size, err := packet.ZeroRun()
+		if err != nil {
+			return err
+		}
+		ss.zeros += size
+		return nil
+	}
+
+	if err := ss.Flush(); err != nil {
+		return err
+	}
+	return ss.sink.WritePacket(packet)
+}
+
+// splits data into literals and zero runs, a run continues the open one
+// when it starts the data and is kept in the literal when it is short
+func (ss *sparseSink) writeLiteral(data []byte) error {
+	// start of the literal data that is not sent yet
+	literal := 0
+	for offset := 0; offset < len(data); {
+		start, end := zeroRun(data[offset:])
+		start, end = start+offset, end+offset
+		if start == len(data) {
+			break
+		}
+		whole := start == 0 && end == len(data)
+		if !whole && end-start < SPARSE_MIN_RUN && (start != literal || ss.zeros == 0) {
+			// too short, look for the next run after it
+			offset = end
+			continue
+		}
+
+		if err := ss.writeData(data[literal:start]); err != nil {
+			return err
+		}
+		ss.zeros += uint64(end - start)
+		literal, offset = end, end
+	}
+	return ss.writeData(data[literal:])
+}
+
+func (ss *sparseSink) writeData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := ss.Flush(); err != nil {
+		return err
+	}
+	return ss.sink.WritePacket(ResponsePacket{A_BLOCK, data})
+}
+
+// the copied chunks that only hold zeros become zero runs,
+// the others are copied like before
+func (ss *sparseSink) writeRange(packet ResponsePacket) error {
+	first, last, err := packet.ChunkRange()
+	if err != nil {
+		return err
+	}
+
+	copyFirst := first
+	for idx := first; idx <= last; idx++ {
+		chunk, err := ss.chunkAt(idx)
+		if err != nil {
+			return err
+		}
+		if !ss.isZeroChunk(chunk) {
+			continue
+		}
+		if err := ss.writeCopy(copyFirst, idx); err != nil {
+			return err
+		}
+		ss.zeros += chunk.Size
+		copyFirst = idx + 1
+	}
+	return ss.writeCopy(copyFirst, last+1)
+}
+
+// copies the chunks from first up to end, without end
+func (ss *sparseSink) writeCopy(first, end uint64) error {
+	if first == end {
+		return nil
+	}
+	if err := ss.Flush(); err != nil {
+		return err
+	}
+	if first == end-1 {
+		return ss.sink.WritePacket(newIndexPacket(B_BLOCK, first))
+	}
+	return ss.sink.WritePacket(newIndexPacket(R_BLOCK, first, end-1))
+}
+
+func (ss *sparseSink) isZeroChunk(chunk *Chunk) bool {
+	zeroHash, ok := ss.zeroHashes[chunk.Size]
+	if !ok {
+		zeroHash = ss.hasher.Sum(make([]byte, chunk.Size))
+		ss.zeroHashes[chunk.Size] = zeroHash
+	}
+	return bytes.Equal(chunk.StrongHash, zeroHash)
+}
+
+func (ss *sparseSink) Flush() error {
+	if ss.zeros == 0 {
+		return nil
+	}
+	zeros := ss.zeros
+	ss.zeros = 0
+	return ss.sink.WritePacket(newIndexPacket(H_BLOCK, zeros))
+}
+
+// bounds of the first run of zeros in data, start is len(data) without one
+func zeroRun(data []byte) (start, end int) {
+	start = 0
+	for start < len(data) && data[start] != 0 {
+		start++
+	}
+	end = start
+	for end < len(data) && data[end] == 0 {
+		end++
+	}
+	return start, end
+}
+
+// reads endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for idx := range p {
+		p[idx] = 0
+	}
+	return len(p), nil
+}
+
+// a region of a file that has no data on the disk and reads as zeros
+type hole struct {
+	offset uint64
+	size   uint64
+}
+
+// the holes of file, in order. A file system that can not
+// report them makes the file look like it has none
+func findHoles(file *os.File, fileSize uint64) []hole {
+	if fileSize == 0 {
+		return nil
+	}
+
+	var holes []hole
+	var offset int64
+	for uint64(offset) < fileSize {
+		start, err := file.Seek(offset, SEEK_HOLE)
+		if err != nil || uint64(start) >= fileSize {
+			break
+		}
+		end, err := file.Seek(start, SEEK_DATA)
+		if err != nil || uint64(end) > fileSize {
+			// no data after the hole
+			end = int64(fileSize)
+		}
+		holes = append(holes, hole{uint64(start), uint64(end - start)})
+		offset = end
+	}
+
+	file.Seek(0, io.SeekStart)
+	return holes
+}
+
+// the bytes from offset to offset+size are all in a hole
+func inHole(holes []hole, offset, size uint64) bool {
+	idx := sort.Search(len(holes), func(idx int) bool {
+		return holes[idx].offset+holes[idx].size > offset
+	})
+	return idx < len(holes) && holes[idx].offset <= offset && offset+size <= holes[idx].offset+holes[idx].size
+}
+
+// reads a file of size bytes from the start, the holes are
+// filled with zeros without reading them from the disk
+type holeReader struct {
+	file   io.ReaderAt
+	holes  []hole
+	offset uint64
+	size   uint64
+}
+
+func (hr *holeReader) Read(p []byte) (int, error) {
+	if hr.offset >= hr.size {
+		return 0, io.EOF
+	}
+	if rest := hr.size - hr.offset; uint64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	for len(hr.holes) > 0 && hr.holes[0].offset+hr.holes[0].size <= hr.offset {
+		hr.holes = hr.holes[1:]
+	}
+	if len(hr.holes) > 0 {
+		next := hr.holes[0]
+		if next.offset <= hr.offset {
+			if rest := next.offset + next.size - hr.offset; uint64(len(p)) > rest {
+				p = p[:rest]
+			}
+			for idx := range p {
+				p[idx] = 0
+			}
+			hr.offset += uint64(len(p))
+			return len(p), nil
+		}
+		// only read up to the hole
+		if rest := next.offset - hr.offset; uint64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+
+	n, err := hr.file.ReadAt(p, int64(hr.offset))
+	hr.offset += uint64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
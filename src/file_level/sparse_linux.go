@@ -0,0 +1,7 @@
+package file_level
+
+// whence values of lseek that find the data and holes of a file
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package file_level
+
+// other systems number them differently or lack them, seeking with
+// an unknown whence fails and files are read as if they had no holes
+const (
+	SEEK_DATA = -1
+	SEEK_HOLE = -2
+)
@@ -0,0 +1,167 @@
+package file_level
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+type HashAlgorithm uint8
+
+// the values are sent in the handshake and stored in signature and delta
+// files, so they can not change. MD5 is the zero value, the hash the
+// protocol used before it could be picked
+const (
+	HASH_MD5 HashAlgorithm = iota
+	HASH_SHA256
+	HASH_BLAKE2B
+	HASH_XXH3
+	// rdiff signatures only, it can not be parsed or picked for a sync
+	HASH_MD4
+)
+
+var (
+	ErrUnknownHash      = errors.New("unknown strong hash algorithm")
+	ErrHashSizeMismatch = errors.New("remote chunks do not match the strong hash of the source file")
+)
+
+// the strong hash confirms a weak checksum match and verifies whole files
+type StrongHasher interface {
+	// streaming hash, used for whole file verification
+	New() hash.Hash
+	// one shot hash of a block
+	Sum(data []byte) []byte
+	Size() int
+}
+
+type strongHasher struct {
+	size    int
+	newHash func() hash.Hash
+	sum     func(data []byte) []byte
+}
+
+// bytes of the 128 bit xxh3 digest
+const XXH3_SIZE = 16
+
+// xxh3.Hasher sums 64 bits, the hash of HASH_XXH3 is the 128 bit one
+type xxh3Hash struct {
+	*xxh3.Hasher
+}
+
+func (h xxh3Hash) Size() int {
+	return XXH3_SIZE
+}
+
+func (h xxh3Hash) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+func (sh strongHasher) New() hash.Hash {
+	return sh.newHash()
+}
+
+func (sh strongHasher) Sum(data []byte) []byte {
+	return sh.sum(data)
+}
+
+func (sh strongHasher) Size() int {
+	return sh.size
+}
+
+var strongHashers = map[HashAlgorithm]StrongHasher{
+	HASH_MD5: strongHasher{
+		size:    md5.Size,
+		newHash: md5.New,
+		sum: func(data []byte) []byte {
+			sum := md5.Sum(data)
+			return sum[:]
+		},
+	},
+	HASH_SHA256: strongHasher{
+		size:    sha256.Size,
+		newHash: sha256.New,
+		sum: func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			return sum[:]
+		},
+	},
+	HASH_BLAKE2B: strongHasher{
+		size: blake2b.Size256,
+		newHash: func() hash.Hash {
+			// only a key longer than 64 bytes is an error, there is none
+			h, _ := blake2b.New256(nil)
+			return h
+		},
+		sum: func(data []byte) []byte {
+			sum := blake2b.Sum256(data)
+			return sum[:]
+		},
+	},
+	HASH_XXH3: strongHasher{
+		size:    XXH3_SIZE,
+		newHash: func() hash.Hash { return xxh3Hash{xxh3.New()} },
+		sum: func(data []byte) []byte {
+			sum := xxh3.Hash128(data).Bytes()
+			return sum[:]
+		},
+	},
+	HASH_MD4: strongHasher{
+		// only here because rdiff signatures use it
+		size:    md4.Size,
+		newHash: md4.New,
+		sum: func(data []byte) []byte {
+			h := md4.New()
+			h.Write(data)
+			return h.Sum(nil)
+		},
+	},
+}
+
+var hashNames = map[HashAlgorithm]string{
+	HASH_MD5:     "md5",
+	HASH_SHA256:  "sha256",
+	HASH_BLAKE2B: "blake2b",
+	HASH_XXH3:    "xxh3",
+	HASH_MD4:     "md4",
+}
+
+func (algo HashAlgorithm) Hasher() (StrongHasher, error) {
+	hasher, ok := strongHashers[algo]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownHash, algo)
+	}
+	return hasher, nil
+}
+
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	for algo, algoName := range hashNames {
+		if algoName == strings.ToLower(name) && algo != HASH_MD4 {
+			return algo, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownHash, name)
+}
+
+// names of every algorithm a sync can use, used in help messages
+func HashAlgorithmNames() []string {
+	names := make([]string, 0, len(hashNames))
+	for algo := HASH_MD5; algo < HASH_MD4; algo++ {
+		names = append(names, hashNames[algo])
+	}
+	return names
+}
+
+func (algo HashAlgorithm) String() string {
+	if name, ok := hashNames[algo]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", algo)
+}
@@ -0,0 +1,434 @@
+package file_level
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	// offsets of a cloned range are multiples of it, the usual file system block
+	CLONE_ALIGN = 4096
+	// buffer of the copies that go through user space
+	COPY_BUFFER_SIZE = 1 << 17
+)
+
+var (
+	ErrChunkIndex = errors.New("chunk index out of range")
+	ErrPacketType = errors.New("unknown packet type")
+	ErrSelfRange  = errors.New("copy from output data that was not written yet")
+	ErrSyncedHash = errors.New("synced file does not match the hash of the source")
+)
+
+// rebuilds the source file from the remote file and the packets of a delta,
+// packets can be written as they arrive so the delta never has to be in memory
+type SyncedFileWriter struct {
+	remoteFile *RemoteFile
+	basis      io.ReaderAt
+	// the basis when the writer opened it, closed with the writer
+	basisFile File
+	// every write goes to out, it is the synced file unless
+	// the writer was made with NewSyncedWriter
+	out        io.Writer
+	syncedFile File
+	// where the synced file and its temporary file are
+	fs FS
+	// where the synced file ends up and the temporary file written
+	// until Close, there is no temporary file in place
+	filePath string
+	tmpPath  string
+	// bytes of the synced file written so far
+	written uint64
+	// basis and synced file are the same file
+	inPlace bool
+	// set once the file system refused to clone a range
+	noClone bool
+	// reused by the copies the kernel can not do
+	copyBuf []byte
+	stats   CopyStats
+
+	inflater inflater
+}
+
+// bytes the writer copied from the basis or from the synced file itself, by the
+// way they were copied
+type CopyStats struct {
+	// shared with the basis by FICLONERANGE, nothing was copied
+	Cloned uint64
+	// copied from file to file by os.File, with copy_file_range on Linux
+	FileCopied uint64
+	// read and written again through the copy buffer
+	Buffered uint64
+}
+
+func (w *SyncedFileWriter) CopyStats() CopyStats {
+	return w.stats
+}
+
+// when replace is set the remote file is replaced by the synced file on Close,
+// otherwise the synced file is written to filePath. Either way the packets go to
+// a temporary file that only takes the place of the destination once complete
+func (rf *RemoteFile) NewSyncedFileWriter(filePath string, replace bool) (*SyncedFileWriter, error) {
+	if replace {
+		filePath = rf.FilePath
+	}
+
+	basis, basisFile, err := rf.openBasisReader()
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := OrOS(rf.fs)
+	syncedFile, tmpPath, err := createTemp(fsys, filePath)
+	if err != nil {
+		if basisFile != nil {
+			basisFile.Close()
+		}
+		return nil, err
+	}
+
+	return &SyncedFileWriter{
+		remoteFile: rf,
+		basis:      basis,
+		basisFile:  basisFile,
+		out:        syncedFile,
+		syncedFile: syncedFile,
+		fs:         fsys,
+		filePath:   filePath,
+		tmpPath:    tmpPath,
+	}, nil
+}
+
+// writer that streams the synced file to out, which stays open on Close.
+// S_BLOCK packets read back what was written, they need out to be an io.ReaderAt
+func (rf *RemoteFile) NewSyncedWriter(out io.Writer) (*SyncedFileWriter, error) {
+	basis, basisFile, err := rf.openBasisReader()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyncedFileWriter{
+		remoteFile: rf,
+		basis:      basis,
+		basisFile:  basisFile,
+		out:        out,
+	}, nil
+}
+
+// the basis the remote file was made from, a file is opened again by its path
+func (rf *RemoteFile) openBasisReader() (io.ReaderAt, File, error) {
+	if rf.basis != nil {
+		return rf.basis, nil, nil
+	}
+	file, err := openBasis(OrOS(rf.fs), rf.FilePath, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+func (w *SyncedFileWriter) WritePacket(packet ResponsePacket) error {
+	switch packet.BlockType {
+	case A_BLOCK:
+		return w.write(packet.Data)
+	case Z_BLOCK:
+		data, err := w.inflater.inflate(packet.Data, nil, w.remoteFile.Params.MaxChunkSize())
+		if err != nil {
+			return err
+		}
+		return w.write(data)
+	case D_BLOCK:
+		if w.inPlace {
+			// the dictionary chunks may be overwritten already
+			return fmt.Errorf("%w: %v in place", ErrPacketType, packet.BlockType)
+		}
+		dict, compressed, err := w.readDict(packet.Data)
+		if err != nil {
+			return err
+		}
+		data, err := w.inflater.inflate(compressed, dict, w.remoteFile.Params.MaxChunkSize())
+		if err != nil {
+			return err
+		}
+		return w.write(data)
+	case B_BLOCK, R_BLOCK:
+		first, last, err := packet.ChunkRange()
+		if err != nil {
+			return err
+		}
+		offset, size, err := w.remoteFile.chunkRange(first, last)
+		if err != nil {
+			return err
+		}
+
+		// a whole range is a single copy
+		if err := w.copyBasis(offset, size); err != nil {
+			return fmt.Errorf("chunks %d..%d: %w", first, last, err)
+		}
+		return nil
+	case S_BLOCK:
+		offset, size, err := packet.SelfRange()
+		if err != nil {
+			return err
+		}
+		if offset+size < offset || offset+size > w.written {
+			return fmt.Errorf("%w: %d bytes at %d, %d written", ErrSelfRange, size, offset, w.written)
+		}
+		written, err := w.readBack()
+		if err != nil {
+			return err
+		}
+		return w.copyFrom(written, offset, size)
+	case H_BLOCK:
+		size, err := packet.ZeroRun()
+		if err != nil {
+			return err
+		}
+		return w.skipZeros(size)
+	default:
+		return fmt.Errorf("%w: %v", ErrPacketType, packet.BlockType)
+	}
+}
+
+func (w *SyncedFileWriter) write(data []byte) error {
+	n, err := w.out.Write(data)
+	w.written += uint64(n)
+	return err
+}
+
+// the output written so far, to copy from it
+func (w *SyncedFileWriter) readBack() (io.ReaderAt, error) {
+	if w.syncedFile != nil {
+		return w.syncedFile, nil
+	}
+	if written, ok := w.out.(io.ReaderAt); ok {
+		return written, nil
+	}
+	return nil, fmt.Errorf("%w: %v needs to read the output", ErrNoRandomAccess, S_BLOCK)
+}
+
+func (w *SyncedFileWriter) copyBasis(offset, size uint64) error {
+	if !w.inPlace {
+		return w.copyFrom(w.basis, offset, size)
+	}
+
+	switch {
+	case offset == w.written:
+		// already in place
+		if _, err := w.syncedFile.Seek(int64(size), io.SeekCurrent); err != nil {
+			return err
+		}
+		w.written += size
+		return nil
+	case offset < w.written:
+		return fmt.Errorf("%w: %d bytes at %d, %d written", ErrInPlaceOrder, size, offset, w.written)
+	default:
+		// copies towards the start of the file, every byte is read before it is overwritten
+		return w.copyFrom(w.basis, offset, size)
+	}
+}
+
+// leaves a hole of size bytes. The file is extended over it right away,
+// an S_BLOCK can copy the zeros back before anything is written after them.
+// In place the old data has to be overwritten, a stream can not have holes
+func (w *SyncedFileWriter) skipZeros(size uint64) error {
+	if w.inPlace || w.syncedFile == nil {
+		n, err := io.CopyN(w.out, zeroReader{}, int64(size))
+		w.written += uint64(n)
+		return err
+	}
+
+	if _, err := w.syncedFile.Seek(int64(size), io.SeekCurrent); err != nil {
+		return err
+	}
+	w.written += size
+	return w.syncedFile.Truncate(int64(w.written))
+}
+
+// appends size bytes of src from offset, the source range
+// of a copy from the synced file itself is already written
+func (w *SyncedFileWriter) copyFrom(src io.ReaderAt, offset, size uint64) error {
+	var n int64
+	var err error
+	file, isFile := src.(*os.File)
+	dst, dstIsFile := w.syncedFile.(*os.File)
+	if !isFile || !dstIsFile || file == dst {
+		// the kernel only copies between two os files, for the synced file
+		// itself there is one file offset for reading and writing and
+		// the kernel also refuses to copy overlapping ranges of a file
+		n, err = w.copyBuffered(src, offset, size)
+		w.stats.Buffered += uint64(n)
+	} else if w.clone(dst, file, offset, size) {
+		n = int64(size)
+		_, err = w.syncedFile.Seek(n, io.SeekCurrent)
+		w.stats.Cloned += uint64(n)
+	} else if _, err = file.Seek(int64(offset), io.SeekStart); err == nil {
+		// copy_file_range between two files, os.File
+		// falls back to reading and writing by itself
+		n, err = io.Copy(w.syncedFile, io.LimitReader(file, int64(size)))
+		w.stats.FileCopied += uint64(n)
+	}
+
+	w.written += uint64(n)
+	if err == nil && uint64(n) != size {
+		err = fmt.Errorf("%w: %d of %d bytes at %d", ErrShortRead, n, size, offset)
+	}
+	return err
+}
+
+// shares the blocks of the range instead of copying them, file systems
+// only clone whole blocks, so the offsets have to be aligned to them
+func (w *SyncedFileWriter) clone(dst, file *os.File, offset, size uint64) bool {
+	if w.noClone || offset%CLONE_ALIGN != 0 || w.written%CLONE_ALIGN != 0 {
+		return false
+	}
+
+	err := cloneRange(dst, file, w.written, offset, size)
+	if err != nil && !errors.Is(err, syscall.EINVAL) {
+		// no reflinks on this file system or between these files
+		w.noClone = true
+	}
+	return err == nil
+}
+
+func (w *SyncedFileWriter) copyBuffered(src io.ReaderAt, offset, size uint64) (int64, error) {
+	if w.copyBuf == nil {
+		w.copyBuf = make([]byte, COPY_BUFFER_SIZE)
+	}
+	// a plain writer, so the buffer is used instead of os.File.ReadFrom
+	return io.CopyBuffer(struct{ io.Writer }{w.out},
+		io.NewSectionReader(src, int64(offset), int64(size)), w.copyBuf)
+}
+
+// syncs the synced file to disk and moves it to its destination,
+// on an error the destination stays as it was. The out of
+// NewSyncedWriter is left to the caller
+func (w *SyncedFileWriter) Close() error {
+	if err := w.closeFiles(); err != nil {
+		w.removeTemp()
+		return err
+	}
+	return w.commit()
+}
+
+// like Close, but the synced file is only kept when its algo hash is
+// fileSum, otherwise it is removed and the remote file stays untouched
+func (w *SyncedFileWriter) CloseVerified(algo HashAlgorithm, fileSum []byte) error {
+	return w.CloseChecked(func(filePath string) error {
+		sum, err := GetFileHashFS(w.fs, filePath, algo)
+		if err == nil && !bytes.Equal(sum, fileSum) {
+			err = fmt.Errorf("%w: %v is %x, want %x", ErrSyncedHash, algo, sum, fileSum)
+		}
+		return err
+	})
+}
+
+// like Close, but check gets the path of the complete synced file, in the FS
+// of the writer, before it takes the place of the destination. An error of
+// check drops the synced file. The output of NewSyncedWriter is not a file,
+// it can not be checked
+func (w *SyncedFileWriter) CloseChecked(check func(filePath string) error) error {
+	if w.syncedFile == nil {
+		w.closeFiles()
+		return fmt.Errorf("%w: the output is not a file to check", ErrNoRandomAccess)
+	}
+	err := w.closeFiles()
+	if err == nil {
+		checkPath := w.tmpPath
+		if w.inPlace {
+			checkPath = w.filePath
+		}
+		err = check(checkPath)
+	}
+	if err != nil {
+		w.removeTemp()
+		return err
+	}
+	return w.commit()
+}
+
+func (w *SyncedFileWriter) closeFiles() error {
+	if w.basisFile != nil && !w.inPlace {
+		w.basisFile.Close()
+	}
+	if w.syncedFile == nil {
+		return nil
+	}
+
+	// the synced file can end with a hole, or in place
+	// be shorter than the basis it overwrote
+	if err := w.syncedFile.Truncate(int64(w.written)); err != nil {
+		w.syncedFile.Close()
+		return err
+	}
+
+	// the data has to be on disk before the rename makes it the destination
+	if err := w.syncedFile.Sync(); err != nil {
+		w.syncedFile.Close()
+		return err
+	}
+	return w.syncedFile.Close()
+}
+
+func (w *SyncedFileWriter) commit() error {
+	if w.tmpPath == "" {
+		return nil
+	}
+	return commitTemp(w.fs, w.tmpPath, w.filePath)
+}
+
+// an in place update can not be undone, there is nothing to remove
+func (w *SyncedFileWriter) removeTemp() {
+	if w.tmpPath != "" {
+		w.fs.Remove(w.tmpPath)
+	}
+}
+
+// drops the partially written file and keeps the remote file untouched,
+// in place the remote file stays as far as it was updated
+func (w *SyncedFileWriter) Abort() {
+	if w.syncedFile != nil {
+		w.syncedFile.Close()
+	}
+	if w.basisFile != nil && !w.inPlace {
+		w.basisFile.Close()
+	}
+	w.removeTemp()
+}
+
+func (rf *RemoteFile) chunkAt(idx uint64) (*Chunk, error) {
+	if idx >= uint64(len(rf.ChunkList)) {
+		return nil, fmt.Errorf("%w: %d of %d", ErrChunkIndex, idx, len(rf.ChunkList))
+	}
+	return &rf.ChunkList[idx], nil
+}
+
+func (rf *RemoteFile) WriteSyncedFile(response *Response, filePath string, replace bool) error {
+	w, err := rf.NewSyncedFileWriter(filePath, replace)
+	if err != nil {
+		return err
+	}
+	return w.writeResponse(response)
+}
+
+// like WriteSyncedFile, but the synced file is written to out
+func (rf *RemoteFile) WriteSynced(response *Response, out io.Writer) error {
+	w, err := rf.NewSyncedWriter(out)
+	if err != nil {
+		return err
+	}
+	return w.writeResponse(response)
+}
+
+func (w *SyncedFileWriter) writeResponse(response *Response) error {
+	for idx := range *response {
+		if err := w.WritePacket((*response)[idx]); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -1,21 +1,30 @@
 package file_level
 
 import (
-	"crypto/md5"
 	"io"
 	"os"
 )
 
-func GetFileMD5(filename string) ([16]byte, error) {
-	f, err := os.Open(filename)
+func GetFileHash(filename string, algo HashAlgorithm) ([]byte, error) {
+	return GetFileHashFS(OSFS{}, filename, algo)
+}
+
+// like GetFileHash for a file of fsys
+func GetFileHashFS(fsys FS, filename string, algo HashAlgorithm) ([]byte, error) {
+	hasher, err := algo.Hasher()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.OpenFile(filename, os.O_RDONLY, 0)
 	if err != nil {
-		return [16]byte{}, err
+		return nil, err
 	}
 	defer f.Close()
 
-	h := md5.New()
+	h := hasher.New()
 	if _, err := io.Copy(h, f); err != nil {
-		return [16]byte{}, err
+		return nil, err
 	}
-	return [16]byte(h.Sum(nil)), err
+	return h.Sum(nil), err
 }
@@ -0,0 +1,72 @@
+package file_level
+
+import (
+	"bytes"
+	"io"
+)
+
+// sends the whole source as literal data, for destinations without a basis
+// or when computing a delta costs more than sending everything.
+// Packets are at most one chunk long, like the literals of a search
+func (sf *SourceFile) WholeFileTo(sink PacketSink) error {
+	if !sf.Sparse {
+		return sf.wholeFileTo(sink)
+	}
+
+	sparse := newSparseSink(sink, nil, nil)
+	if err := sf.wholeFileTo(sparse); err != nil {
+		return err
+	}
+	return sparse.Flush()
+}
+
+func (sf *SourceFile) wholeFileTo(sink PacketSink) error {
+	// holes are not read, with Sparse they are sent as zero runs
+	var reader io.Reader = &holeReader{file: sf.source, holes: sf.holes, size: sf.FileSize}
+	if sf.source == nil {
+		// a stream can not be read again, its start is in the window already
+		reader = io.MultiReader(bytes.NewReader(sf.slidingWin.buffer[:sf.slidingWin.cap]), sf.reader)
+	}
+	buf := make([]byte, sf.Params.MaxChunkSize())
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			// the sink may keep the packet, the buffer is reused
+			if err := sink.WritePacket(ResponsePacket{
+				A_BLOCK,
+				append([]byte(nil), buf[:n]...),
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writer for a file that has no basis, every packet has to carry
+// its own data. An existing file at filePath is replaced on Close
+func NewWholeFileWriter(filePath string, params SyncParams) (*SyncedFileWriter, error) {
+	return NewWholeFileWriterFS(OSFS{}, filePath, params)
+}
+
+// like NewWholeFileWriter for a file of fsys
+func NewWholeFileWriterFS(fsys FS, filePath string, params SyncParams) (*SyncedFileWriter, error) {
+	syncedFile, tmpPath, err := createTemp(fsys, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyncedFileWriter{
+		remoteFile: &RemoteFile{FilePath: filePath, Params: params, fs: fsys},
+		out:        syncedFile,
+		syncedFile: syncedFile,
+		fs:         fsys,
+		filePath:   filePath,
+		tmpPath:    tmpPath,
+	}, nil
+}
@@ -1,5 +1,7 @@
 package options
 
+import "github.com/andreistan26/sync/src/file_level"
+
 type ExchangeType int
 
 const (
@@ -7,6 +9,11 @@ const (
 	TCP_EX
 )
 
+const (
+	DEFAULT_PORT     = 8080
+	DEFAULT_MAX_REDO = 2
+)
+
 type AddressPath struct {
 	User     string
 	Address  string
@@ -20,4 +27,116 @@ type Options struct {
 
 	Verbose  bool
 	IsServer bool
+	Port     int
+
+	// 0 means the block size is picked from the source file size
+	BlockSize uint64
+	Hash      string
+	Chunking  string
+	// goroutines used to compute signatures, 0 uses every cpu
+	Workers int
+	// literal data is deflated with CompressLevel when Compress is set,
+	// CompressBasis also primes it with the basis chunks matched last
+	Compress      bool
+	CompressBasis bool
+	CompressLevel int
+	// data repeated in the source is copied from the output the second time
+	SelfRefs bool
+	// send the whole source without computing a delta
+	WholeFile bool
+	// update the destination directly instead of replacing it with a new copy
+	InPlace bool
+	// runs of zeros become holes of the destination
+	Sparse bool
+
+	// where the local files are, nil is the real file system
+	FS file_level.FS
+}
+
+type ServerOptions struct {
+	Port int
+	// goroutines used to compute signatures, 0 uses every cpu
+	Workers int
+	// strong hash algorithms clients may pick, empty allows the ones of
+	// DefaultAllowedHashes
+	AllowedHashes []string
+	// passes after the first one when the synced file does not match the source
+	MaxRedo int
+
+	// where the destinations are, nil is the real file system
+	FS file_level.FS
+}
+
+// exchange parameters derived from the command line, sourceSize is
+// used to pick the block size when none was given
+func (opts *Options) SyncParams(sourceSize uint64) file_level.SyncParams {
+	params := file_level.DefaultSyncParams()
+	if opts.BlockSize != 0 {
+		params.BlockSize = opts.BlockSize
+	} else {
+		params.BlockSize = file_level.BlockSizeFor(sourceSize)
+	}
+	if opts.Hash != "" {
+		// already checked by the argument validator
+		params.HashAlgorithm, _ = file_level.ParseHashAlgorithm(opts.Hash)
+	}
+	if opts.Chunking != "" {
+		params.Chunking, _ = file_level.ParseChunkingMode(opts.Chunking)
+	}
+	return params
+}
+
+// compression level to ask the server for, 0 when compression is off
+func (opts *Options) CompressionLevel() int {
+	if !opts.Compress && !opts.CompressBasis {
+		return 0
+	}
+	return opts.CompressLevel
+}
+
+// every algorithm but MD5, it is only accepted when the server names it
+func DefaultAllowedHashes() []string {
+	var names []string
+	for _, name := range file_level.HashAlgorithmNames() {
+		if name != file_level.HASH_MD5.String() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (opts *ServerOptions) AllowsHash(algo file_level.HashAlgorithm) bool {
+	allowed := opts.AllowedHashes
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedHashes()
+	}
+	for _, name := range allowed {
+		if allowed, err := file_level.ParseHashAlgorithm(name); err == nil && allowed == algo {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveWorkers(workers int) int {
+	if workers <= 0 {
+		return file_level.DefaultWorkers()
+	}
+	return workers
+}
+
+func (opts *Options) WorkerCount() int {
+	return resolveWorkers(opts.Workers)
+}
+
+func (opts *ServerOptions) WorkerCount() int {
+	return resolveWorkers(opts.Workers)
+}
+
+func (opts *Options) FileSystem() file_level.FS {
+	return file_level.OrOS(opts.FS)
+}
+
+func (opts *ServerOptions) FileSystem() file_level.FS {
+	return file_level.OrOS(opts.FS)
 }
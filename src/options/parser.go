@@ -16,8 +16,7 @@ func (addrPath *AddressPath) parse(arg string) error {
 	case 2:
 		addr := strings.Split(res[0], "@")
 		if len(addr) != 2 {
-			fmt.Print(ErrInvalidAddress)
-			return ErrInvalidAddress
+			return fmt.Errorf("%w: %s", ErrInvalidAddress, arg)
 		}
 		addrPath.Filepath = res[1]
 		addrPath.User = addr[0]
@@ -25,37 +24,36 @@ func (addrPath *AddressPath) parse(arg string) error {
 	case 1:
 		addrPath.Filepath = res[0]
 	default:
-		fmt.Print(ErrInvalidAddress)
-		return ErrInvalidAddress
+		return fmt.Errorf("%w: %s", ErrInvalidAddress, arg)
 	}
 	return nil
 }
 
 func (addrPath *AddressPath) ParseSource(arg string) error {
 	err := addrPath.parse(arg)
-	if addrPath.User != "" || addrPath.Address != "" {
-		return ErrInvalidAddress
+	if err == nil && (addrPath.User != "" || addrPath.Address != "") {
+		return fmt.Errorf("%w: the source has to be a local file, not %s", ErrInvalidAddress, arg)
 	}
 	return err
 }
 
 func (addrPath *AddressPath) ParseDest(arg string) (ExchangeType, error) {
-	err := addrPath.parse(arg)
-	if err == nil && addrPath.Address != "" {
+	if err := addrPath.parse(arg); err != nil {
+		return LOCAL_EX, err
+	}
+	if addrPath.Address != "" {
 		return TCP_EX, nil
 	}
 	return LOCAL_EX, nil
 }
 
 // assumes that the lenght is at least 2
-func (opts *Options) ParseArgument(arg []string) {
-	err := opts.Source.ParseSource(arg[0])
-	if err != nil {
-		panic(err)
+func (opts *Options) ParseArgument(arg []string) error {
+	if err := opts.Source.ParseSource(arg[0]); err != nil {
+		return err
 	}
 
+	var err error
 	opts.ExType, err = opts.Dest.ParseDest(arg[1])
-	if err != nil {
-		panic(err)
-	}
+	return err
 }
@@ -2,9 +2,12 @@ package transport
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+
+	"github.com/andreistan26/sync/src/file_level"
 )
 
 type SyncConn struct {
@@ -40,3 +43,58 @@ func (conn *SyncConn) Encode(e any) error {
 	}
 	return err
 }
+
+// gob leaves zero fields out, so every status is decoded
+// into a fresh value, STATUS_FILE_SYNCED would not overwrite anything
+func (conn *SyncConn) DecodeStatus() (StatusMessages, error) {
+	var status StatusMessages
+	err := conn.Decode(&status)
+	return status, err
+}
+
+// sends a single packet of the delta, implements file_level.PacketSink
+func (conn *SyncConn) WritePacket(packet file_level.ResponsePacket) error {
+	return conn.Encode(PacketFrame{Packet: packet})
+}
+
+func (conn *SyncConn) EndPackets() error {
+	return conn.Encode(PacketFrame{Done: true})
+}
+
+// forwards every received packet to sink until the end of the stream
+func (conn *SyncConn) ReceivePackets(sink file_level.PacketSink) error {
+	for {
+		var frame PacketFrame
+		if err := conn.Decode(&frame); err != nil {
+			return err
+		}
+		if frame.Done {
+			return nil
+		}
+		if err := sink.WritePacket(frame.Packet); err != nil {
+			return err
+		}
+	}
+}
+
+// feeds the signature batches sent by the server into stream until the last one
+func (conn *SyncConn) ReceiveSignatures(stream *file_level.ChunkStream) error {
+	for {
+		var batch SignatureBatch
+		if err := conn.Decode(&batch); err != nil {
+			stream.Close(err)
+			return err
+		}
+		if len(batch.Chunks) > 0 {
+			stream.Add(batch.Chunks)
+		}
+		if batch.Done {
+			var err error
+			if batch.Error != "" {
+				err = errors.New(batch.Error)
+			}
+			stream.Close(err)
+			return err
+		}
+	}
+}
@@ -2,12 +2,56 @@ package transport
 
 import (
 	"fmt"
+
+	"github.com/andreistan26/sync/src/file_level"
 )
 
 // first request client ---> server
+// FileSum is the hash of the whole source file computed with HashAlgorithm,
+// the same algorithm is used for the strong hash of every chunk.
+// A non zero CompressLevel means literal data may come as Z_BLOCK packets,
+// with CompressBasis set also as D_BLOCK packets.
+// WholeFile asks for the whole file even when the server has a basis,
+// InPlace for updating the destination without a temporary copy
 type InitialFileRequest struct {
-	Filename string
-	Md5sum   [16]byte
+	Filename      string
+	FileSum       []byte
+	BlockSize     uint64
+	HashAlgorithm file_level.HashAlgorithm
+	Chunking      file_level.ChunkingMode
+	CompressLevel int
+	CompressBasis bool
+	WholeFile     bool
+	InPlace       bool
+}
+
+// signatures are streamed in batches while the server reads the file,
+// the last batch has Done set and Error describes a failure on the server
+type SignatureBatch struct {
+	Chunks []file_level.Chunk
+	Done   bool
+	Error  string
+}
+
+// follows STATUS_REDO, the next pass uses these parameters
+// and starts with STATUS_SENDING_CHUNKS or STATUS_NO_BASIS again
+type RedoRequest struct {
+	BlockSize     uint64
+	HashAlgorithm file_level.HashAlgorithm
+}
+
+// the client answers a RedoRequest with the hash of the source as it is now,
+// computed with the HashAlgorithm of the InitialFileRequest. A source that
+// changed while it was read is then checked against its new content
+type RedoReply struct {
+	FileSum []byte
+}
+
+// the delta is streamed one packet per frame,
+// the last frame carries no packet and has Done set
+type PacketFrame struct {
+	Packet file_level.ResponsePacket
+	Done   bool
 }
 
 type PacketType int
@@ -26,6 +70,10 @@ const (
 	STATUS_REQUEST_CHUNKS
 	STATUS_SENDING_CHUNKS
 	STATUS_SERVER_ERROR
+	// no signatures follow, the client sends the whole file as literal data
+	STATUS_NO_BASIS
+	// the result did not match the source, a RedoRequest follows
+	STATUS_REDO
 )
 
 type StatusMessages struct {
@@ -42,8 +90,9 @@ func (sm StatusMessages) String() (str string) {
 
 func (ifr InitialFileRequest) String() (str string) {
 	return fmt.Sprintf(
-		"Filename: <%v>, MD5 <%v>\n",
-		ifr.Filename, ifr.Md5sum,
+		"Filename: <%v>, FileSum <%x>, BlockSize <%v>, Hash <%v>, Chunking <%v>, Compress <%v>, Basis <%v>, WholeFile <%v>, InPlace <%v>\n",
+		ifr.Filename, ifr.FileSum, ifr.BlockSize, ifr.HashAlgorithm, ifr.Chunking,
+		ifr.CompressLevel, ifr.CompressBasis, ifr.WholeFile, ifr.InPlace,
 	)
 }
 
@@ -59,6 +108,10 @@ func (status StatusResponse) String() (str string) {
 		return "STATUS_SENDING_CHUNKS"
 	case STATUS_SERVER_ERROR:
 		return "STATUS_SERVER_ERROR"
+	case STATUS_NO_BASIS:
+		return "STATUS_NO_BASIS"
+	case STATUS_REDO:
+		return "STATUS_REDO"
 	default:
 		return fmt.Sprintf("%d", status)
 	}
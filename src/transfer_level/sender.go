@@ -1,60 +1,186 @@
 package transport
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
 
 	"github.com/andreistan26/sync/src/file_level"
 	"github.com/andreistan26/sync/src/options"
 )
 
+var (
+	ErrSyncFailed = errors.New("sync failed on the server")
+)
+
 func SendFile(opts *options.Options) error {
-	sourceFile := file_level.CreateSourceFile(opts.Source.Filepath)
+	fsys := opts.FileSystem()
+	stats, err := fsys.Stat(opts.Source.Filepath)
+	if err != nil {
+		return err
+	}
 
-	netConn, err := net.Dial("tcp4", opts.Dest.Address)
+	params := opts.SyncParams(uint64(stats.Size()))
+	// the whole file hash keeps this algorithm in every pass
+	sumAlgorithm := params.HashAlgorithm
+	fileSum, err := file_level.GetFileHashFS(fsys, opts.Source.Filepath, sumAlgorithm)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		panic(err)
+		log.Printf("Error occured when calculating %v for file %v\n", params.HashAlgorithm, err)
+		return err
 	}
 
-	conn := InitSyncConn(netConn)
+	sourceFile, err := file_level.CreateSourceFileFS(fsys, opts.Source.Filepath, params)
+	if err != nil {
+		return err
+	}
+	sourceFile.Sparse = opts.Sparse
 
-	md5sum, err := file_level.GetFileMD5(opts.Source.Filepath)
+	netConn, err := net.Dial("tcp4", opts.Dest.Address)
 	if err != nil {
-		log.Printf("Error occured when calculating md5 for file %v\n", err)
-		panic(err)
+		sourceFile.File.Close()
+		return err
 	}
 
-	conn.Encode(InitialFileRequest{
-		Filename: opts.Dest.Filepath,
-		Md5sum:   md5sum,
-	})
+	conn := InitSyncConn(netConn)
 
+	err = conn.Encode(InitialFileRequest{
+		Filename:      opts.Dest.Filepath,
+		FileSum:       fileSum,
+		BlockSize:     params.BlockSize,
+		HashAlgorithm: params.HashAlgorithm,
+		Chunking:      params.Chunking,
+		CompressLevel: opts.CompressionLevel(),
+		CompressBasis: opts.CompressBasis,
+		WholeFile:     opts.WholeFile,
+		InPlace:       opts.InPlace,
+	})
 	var statusMsg StatusMessages
-	conn.Decode(&statusMsg)
+	if err == nil {
+		// a failed decode leaves the zero status, STATUS_FILE_SYNCED
+		statusMsg, err = conn.DecodeStatus()
+	}
+	if err != nil {
+		sourceFile.File.Close()
+		netConn.Close()
+		return err
+	}
 
 	if statusMsg.Status != STATUS_SENDING_CHUNKS {
 		log.Println(statusMsg)
 	}
 
-	var remoteChunkList []file_level.Chunk
-	conn.Decode(&remoteChunkList)
+	if statusMsg.Status == STATUS_SERVER_ERROR {
+		sourceFile.File.Close()
+		netConn.Close()
+		return fmt.Errorf("server refused the request: %s", statusMsg.Message)
+	}
 
-	ex, err := file_level.CreateRsyncExchange(&sourceFile, remoteChunkList)
-	if err != nil {
-		panic(err)
+	if statusMsg.Status == STATUS_FILE_EXISTS {
+		fmt.Println("File already up to date")
+		sourceFile.File.Close()
+		netConn.Close()
+		return nil
 	}
 
-	resp := ex.Search()
-	conn.Encode(resp)
+	for statusMsg.Status == STATUS_SENDING_CHUNKS || statusMsg.Status == STATUS_NO_BASIS {
+		if statusMsg.Status == STATUS_NO_BASIS {
+			err = sendWholeFile(conn, &sourceFile, opts)
+		} else {
+			err = sendDelta(conn, &sourceFile, opts)
+		}
+		sourceFile.File.Close()
+		if err == nil {
+			statusMsg, err = conn.DecodeStatus()
+		}
 
-	conn.Decode(&statusMsg)
-	if statusMsg.Status == STATUS_FILE_SYNCED {
-		fmt.Println("File sync succesful!")
+		// the result did not match, another pass with the parameters the server picked
+		if err == nil && statusMsg.Status == STATUS_REDO {
+			var redo RedoRequest
+			if err = conn.Decode(&redo); err == nil {
+				log.Printf("Redo pass with %d byte blocks and %v, %s\n",
+					redo.BlockSize, redo.HashAlgorithm, statusMsg.Message)
+				params.BlockSize = redo.BlockSize
+				params.HashAlgorithm = redo.HashAlgorithm
+				// the source may have changed while the last pass read it
+				fileSum, err = file_level.GetFileHashFS(fsys, opts.Source.Filepath, sumAlgorithm)
+				if err == nil {
+					err = conn.Encode(RedoReply{FileSum: fileSum})
+				}
+				if err == nil {
+					sourceFile, err = file_level.CreateSourceFileFS(fsys, opts.Source.Filepath, params)
+					sourceFile.Sparse = opts.Sparse
+				}
+				if err == nil {
+					statusMsg, err = conn.DecodeStatus()
+				}
+			}
+		}
+		if err != nil {
+			netConn.Close()
+			return err
+		}
 	}
 
 	netConn.Close()
+	if statusMsg.Status != STATUS_FILE_SYNCED {
+		return fmt.Errorf("%w: %s", ErrSyncFailed, statusMsg.Message)
+	}
+	fmt.Println("File sync succesful!")
 	return nil
 }
+
+// matches the source against the signatures the server streams
+func sendDelta(conn *SyncConn, sourceFile *file_level.SourceFile, opts *options.Options) error {
+	// the search starts with the first batch of signatures
+	stream := file_level.NewChunkStream()
+	received := make(chan error, 1)
+	go func() {
+		received <- conn.ReceiveSignatures(stream)
+	}()
+
+	ex, err := file_level.CreateStreamingRsyncExchange(sourceFile, stream)
+	if err != nil {
+		return err
+	}
+
+	ex.Workers = opts.WorkerCount()
+	ex.SelfRefs = opts.SelfRefs
+	ex.InPlace = opts.InPlace
+
+	// the server accepted the level, so it can inflate Z_BLOCK packets
+	var sink file_level.PacketSink = conn
+	if level := opts.CompressionLevel(); opts.CompressBasis {
+		sink, err = ex.NewBasisCompressSink(conn, level)
+	} else if level != 0 {
+		sink, err = file_level.NewCompressSink(conn, level)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := ex.SearchTo(sink); err != nil {
+		return err
+	}
+	conn.EndPackets()
+
+	// the search can be done before the last batch arrives
+	return <-received
+}
+
+// the server has no basis or the client asked for --whole-file
+func sendWholeFile(conn *SyncConn, sourceFile *file_level.SourceFile, opts *options.Options) error {
+	// nothing is matched, so basis compression is plain compression
+	var sink file_level.PacketSink = conn
+	if level := opts.CompressionLevel(); level != 0 {
+		var err error
+		if sink, err = file_level.NewCompressSink(conn, level); err != nil {
+			return err
+		}
+	}
+
+	if err := sourceFile.WholeFileTo(sink); err != nil {
+		return err
+	}
+	return conn.EndPackets()
+}
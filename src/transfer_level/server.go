@@ -1,24 +1,34 @@
 package transport
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"path"
-	"reflect"
 
 	"github.com/andreistan26/sync/src/file_level"
+	"github.com/andreistan26/sync/src/options"
+)
+
+var (
+	ErrHashNotAllowed = errors.New("strong hash algorithm not allowed by the server")
+	ErrRedoLimit      = errors.New("synced file does not match the source after every redo pass")
+	ErrFileSum        = errors.New("source file hash missing or of the wrong size")
 )
 
 type SyncServerTCP struct {
 	Addr    net.Addr
 	Listner net.Listener
+	Opts    *options.ServerOptions
 }
 
-func StartServer(port int) (serv *SyncServerTCP, err error) {
-	serv = &SyncServerTCP{}
-	serv.Listner, err = net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+func StartServer(opts *options.ServerOptions) (serv *SyncServerTCP, err error) {
+	serv = &SyncServerTCP{Opts: opts}
+	serv.Listner, err = net.Listen("tcp", fmt.Sprintf("localhost:%d", opts.Port))
 
 	if err != nil {
 		log.Printf("Error occured when starting server : %v", err)
@@ -37,41 +47,76 @@ func (serv *SyncServerTCP) Run() error {
 		syncConn := InitSyncConn(conn)
 		go func() {
 			defer conn.Close()
-			syncConn.HandleConnection()
+			syncConn.HandleConnection(serv.Opts)
 		}()
 	}
 }
 
 // TODO investigate behavior if file is open by a different process
-func (conn *SyncConn) HandleConnection() error {
+func (conn *SyncConn) HandleConnection(opts *options.ServerOptions) error {
 	// wait for fliepath and checksum
 	initialFileRequest := &InitialFileRequest{}
 	err := conn.Decode(initialFileRequest)
 	if err != nil {
-		log.Println(initialFileRequest.Filename, " ", initialFileRequest.Md5sum)
+		log.Println(initialFileRequest.Filename, " ", initialFileRequest.FileSum)
 		fmt.Printf("Got an error when trying to decode initial file request\n")
 		return err
 	}
 
-	// probe hash in order to check if the file is unmodified
-	md5, err := file_level.GetFileMD5(initialFileRequest.Filename)
-
-	// file exists, md5 crashed
-	if _, ok := err.(*os.PathError); err != nil && !ok {
+	// older clients do not send a block size
+	params := file_level.DefaultSyncParams()
+	if initialFileRequest.BlockSize != 0 {
+		params.BlockSize = initialFileRequest.BlockSize
+	}
+	params.HashAlgorithm = initialFileRequest.HashAlgorithm
+	params.Chunking = initialFileRequest.Chunking
+	err = params.Validate()
+	if err == nil && !opts.AllowsHash(params.HashAlgorithm) {
+		err = fmt.Errorf("%w: %v", ErrHashNotAllowed, params.HashAlgorithm)
+	}
+	if err == nil {
+		// an empty sum would equal the one of a missing destination
+		err = checkFileSum(params.HashAlgorithm, initialFileRequest.FileSum)
+	}
+	if err == nil {
+		err = file_level.ValidateCompressLevel(initialFileRequest.CompressLevel)
+	}
+	if err == nil && initialFileRequest.CompressBasis && initialFileRequest.CompressLevel == 0 {
+		err = fmt.Errorf("%w: basis compression without a level", file_level.ErrInvalidCompressLevel)
+	}
+	if err == nil && initialFileRequest.CompressBasis && initialFileRequest.InPlace {
+		err = fmt.Errorf("%w: basis compression in place", file_level.ErrInvalidCompressLevel)
+	}
+	if err != nil {
 		conn.Encode(StatusMessages{
 			Status:  STATUS_SERVER_ERROR,
-			Message: "Calculating md5sum error",
+			Message: err.Error(),
 		})
-		fmt.Fprintf(os.Stderr, "Got an error from md5 function that is not path related, %v", err)
-	} else if ok {
+		return err
+	}
+
+	// probe hash in order to check if the file is unmodified
+	fsys := opts.FileSystem()
+	fileSum, err := file_level.GetFileHashFS(fsys, initialFileRequest.Filename, params.HashAlgorithm)
+
+	noBasis := initialFileRequest.WholeFile
+	if errors.Is(err, fs.ErrNotExist) {
 		// TODO add config if path is not in system to make or abort
-		// file does not exist, just copy it
+		// file does not exist, there is nothing to compute a delta against
 		dirPath := path.Join(initialFileRequest.Filename, "..")
-		os.MkdirAll(dirPath, os.ModePerm)
+		fsys.MkdirAll(dirPath, os.ModePerm)
+		noBasis = true
+	} else if err != nil {
+		conn.Encode(StatusMessages{
+			Status:  STATUS_SERVER_ERROR,
+			Message: "Calculating file hash error",
+		})
+		fmt.Fprintf(os.Stderr, "Got an error from hash function that is not path related, %v", err)
+		return err
 	}
 
 	// files are the same
-	if reflect.DeepEqual(md5, initialFileRequest.Md5sum) {
+	if bytes.Equal(fileSum, initialFileRequest.FileSum) {
 		conn.Encode(StatusMessages{
 			Status:  STATUS_FILE_EXISTS,
 			Message: "File already exists",
@@ -79,32 +124,135 @@ func (conn *SyncConn) HandleConnection() error {
 		return nil
 	}
 
-	// file exists but is modified
-	conn.Encode(StatusMessages{
-		Status:  STATUS_SENDING_CHUNKS,
-		Message: "Sending Chunks",
-	})
+	for pass := 0; ; pass++ {
+		err = conn.receivePass(initialFileRequest, params, noBasis, opts)
+		if err == nil {
+			conn.Encode(StatusMessages{
+				Status:  STATUS_FILE_SYNCED,
+				Message: "file synced (msg from server)",
+			})
+			return nil
+		}
+		if !errors.Is(err, file_level.ErrSyncedHash) {
+			return err
+		}
+
+		// a false match or a source that changed while it was read
+		if pass >= opts.MaxRedo {
+			err = fmt.Errorf("%w: %d passes, %v", ErrRedoLimit, pass+1, err)
+			log.Printf("Giving up on %v, %v\n", initialFileRequest.Filename, err)
+			conn.Encode(StatusMessages{
+				Status:  STATUS_SERVER_ERROR,
+				Message: err.Error(),
+			})
+			return err
+		}
 
-	// send chunks of data
-	remoteFile := file_level.CreateRemoteFile(initialFileRequest.Filename)
-	conn.Encode(remoteFile.ChunkList)
+		redo := params.Redo()
+		if !opts.AllowsHash(redo.HashAlgorithm) {
+			redo.HashAlgorithm = params.HashAlgorithm
+		}
+		params = redo
+		log.Printf("Redo pass %d for %v, %v\n", pass+1, initialFileRequest.Filename, err)
 
-	// waiting for reponse package
-	var response file_level.Response
-	conn.Decode(&response)
-	log.Printf("%v", response)
-	remoteFile.WriteSyncedFile(&response, initialFileRequest.Filename, true)
+		conn.Encode(StatusMessages{
+			Status:  STATUS_REDO,
+			Message: err.Error(),
+		})
+		conn.Encode(RedoRequest{
+			BlockSize:     params.BlockSize,
+			HashAlgorithm: params.HashAlgorithm,
+		})
+		var reply RedoReply
+		if err := conn.Decode(&reply); err != nil {
+			return err
+		}
+		if err := checkFileSum(initialFileRequest.HashAlgorithm, reply.FileSum); err != nil {
+			return err
+		}
+		initialFileRequest.FileSum = reply.FileSum
+	}
+}
 
-	resultMD5, err := file_level.GetFileMD5(initialFileRequest.Filename)
+// the hash of the source has to be a whole one of algo
+func checkFileSum(algo file_level.HashAlgorithm, fileSum []byte) error {
+	hasher, err := algo.Hasher()
 	if err != nil {
-		log.Printf("Error occured when calculating md5 on final file, %v\n", err)
+		return err
+	}
+	if len(fileSum) != hasher.Size() {
+		return fmt.Errorf("%w: %d bytes of %v, want %d", ErrFileSum, len(fileSum), algo, hasher.Size())
 	}
-	if reflect.DeepEqual(resultMD5, initialFileRequest.Md5sum) {
+	return nil
+}
+
+// one pass of the transfer, the destination is only replaced when
+// the result has the hash of the source. Errors other than
+// file_level.ErrSyncedHash are already reported to the client
+func (conn *SyncConn) receivePass(request *InitialFileRequest, params file_level.SyncParams,
+	noBasis bool, opts *options.ServerOptions) error {
+
+	var writer *file_level.SyncedFileWriter
+	var err error
+	if noBasis {
+		// no signatures, the client sends literal data only
+		conn.Encode(StatusMessages{
+			Status:  STATUS_NO_BASIS,
+			Message: "Send the whole file",
+		})
+		writer, err = file_level.NewWholeFileWriterFS(opts.FileSystem(), request.Filename, params)
+	} else {
+		// file exists but is modified
 		conn.Encode(StatusMessages{
-			Status:  STATUS_FILE_SYNCED,
-			Message: "file synced (msg from server)",
+			Status:  STATUS_SENDING_CHUNKS,
+			Message: "Sending Chunks",
 		})
+
+		// send chunks of data while they are computed
+		var remoteFile file_level.RemoteFile
+		remoteFile, err = file_level.CreateRemoteFileStreamFS(opts.FileSystem(), request.Filename, params, opts.WorkerCount(),
+			func(batch []file_level.Chunk) error {
+				return conn.Encode(SignatureBatch{Chunks: batch})
+			})
+		if err != nil {
+			conn.Encode(SignatureBatch{Done: true, Error: err.Error()})
+			return err
+		}
+		conn.Encode(SignatureBatch{Done: true})
+
+		if request.InPlace {
+			writer, err = remoteFile.NewInPlaceWriter()
+		} else {
+			writer, err = remoteFile.NewSyncedFileWriter(request.Filename, true)
+		}
 	}
-	return nil
 
+	if err != nil {
+		conn.Encode(StatusMessages{
+			Status:  STATUS_SERVER_ERROR,
+			Message: err.Error(),
+		})
+		return err
+	}
+
+	// apply the packets as they arrive
+	if err := conn.ReceivePackets(writer); err != nil {
+		writer.Abort()
+		conn.Encode(StatusMessages{
+			Status:  STATUS_SERVER_ERROR,
+			Message: err.Error(),
+		})
+		return err
+	}
+
+	// the whole file hash is always the one the client asked for
+	err = writer.CloseVerified(request.HashAlgorithm, request.FileSum)
+	if err != nil && !errors.Is(err, file_level.ErrSyncedHash) {
+		log.Printf("Error occured when replacing the synced file, %v\n", err)
+		conn.Encode(StatusMessages{
+			Status:  STATUS_SERVER_ERROR,
+			Message: err.Error(),
+		})
+	}
+	return err
 }
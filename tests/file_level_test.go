@@ -1,10 +1,30 @@
 package sync_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	mrand "math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/andreistan26/sync/src/file_level"
+	"github.com/andreistan26/sync/src/options"
+	transport "github.com/andreistan26/sync/src/transfer_level"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
 )
 
 func TestFileCreate(t *testing.T) {
@@ -14,12 +34,12 @@ func TestFileCreate(t *testing.T) {
 
 	t.Run("Create Remote File", func(t *testing.T) {
 		const default_path string = "test_data/file1_rem.sync"
-		rf = file_level.CreateRemoteFile(default_path)
+		rf = CreateRemoteFile(t, default_path, file_level.DefaultSyncParams())
 	})
 
 	t.Run("Create Source File", func(t *testing.T) {
 		const default_path string = "test_data/file1_src.sync"
-		sf = file_level.CreateSourceFile(default_path)
+		sf = CreateSourceFile(t, default_path, file_level.DefaultSyncParams())
 	})
 
 	t.Run("Create Rsync Exchange", func(t *testing.T) {
@@ -32,33 +52,39 @@ func TestFileCreate(t *testing.T) {
 	})
 
 	t.Run("Perform a search", func(t *testing.T) {
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
 			file_level.A_BLOCK: 1,
-			file_level.B_BLOCK: 3,
+			file_level.B_BLOCK: 1,
+			file_level.R_BLOCK: 1,
 		})
 	})
 }
 
 func TestPerfectMatch(t *testing.T) {
 	// TODO replace this with other global scoped function
+	// consecutive blocks are merged into ranges, count the blocks they copy
 	assert_response_type_B := func(t testing.TB, resp file_level.Response, respSizeRef int) {
 		t.Helper()
 
-		if len(resp) != respSizeRef {
-			t.Errorf(
-				"Resp does not have the right size",
-			)
-		}
-
+		blocks := 0
 		for idx, el := range resp {
-			if el.BlockType != file_level.B_BLOCK {
+			first, last, err := el.ChunkRange()
+			if err != nil {
 				t.Errorf(
-					"Found block of type A{ idx : %d} when i wanted type B!",
-					idx,
+					"Found block of type %v{ idx : %d} when i wanted type B!",
+					el.BlockType, idx,
 				)
+				continue
 			}
+			blocks += int(last-first) + 1
+		}
+
+		if blocks != respSizeRef {
+			t.Errorf(
+				"Resp does not have the right size",
+			)
 		}
 	}
 
@@ -74,12 +100,12 @@ func TestPerfectMatch(t *testing.T) {
 		const default_path_src = "test_data/typeB/1_block_src.sync"
 		const default_path_rem = "test_data/typeB/1_block_rem.sync"
 
-		rf := file_level.CreateRemoteFile(default_path_rem)
-		sf := file_level.CreateSourceFile(default_path_src)
+		rf := CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
 		fmt.Printf("%v", sf)
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		assert_response_type_B(t, resp, 1)
 
@@ -89,11 +115,11 @@ func TestPerfectMatch(t *testing.T) {
 		const default_path_src = "test_data/typeB/2_block_src.sync"
 		const default_path_rem = "test_data/typeB/2_block_rem.sync"
 
-		rf := file_level.CreateRemoteFile(default_path_rem)
-		sf := file_level.CreateSourceFile(default_path_src)
+		rf := CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		assert_response_type_B(t, resp, 2)
 
@@ -103,11 +129,11 @@ func TestPerfectMatch(t *testing.T) {
 		const default_path_src = "test_data/typeB/5_block_src.sync"
 		const default_path_rem = "test_data/typeB/5_block_rem.sync"
 
-		rf := file_level.CreateRemoteFile(default_path_rem)
-		sf := file_level.CreateSourceFile(default_path_src)
+		rf := CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		assert_response_type_B(t, resp, 5)
 		assert_correct_hashmap(t, ex)
@@ -118,11 +144,11 @@ func TestPerfectMatch(t *testing.T) {
 		const default_path_src = "test_data/typeB/128_block_src.sync"
 		const default_path_rem = "test_data/typeB/128_block_rem.sync"
 
-		rf := file_level.CreateRemoteFile(default_path_rem)
-		sf := file_level.CreateSourceFile(default_path_src)
+		rf := CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		assert_response_type_B(t, resp, 128)
 	})
@@ -133,58 +159,2471 @@ func TestReminder(t *testing.T) {
 		const default_path_src = "test_data/remTest/1_chunk_128_rem_src.sync"
 		const default_path_rem = "test_data/remTest/1_chunk_128_rem_rem.sync"
 
-		rf := file_level.CreateRemoteFile(default_path_rem)
-		sf := file_level.CreateSourceFile(default_path_src)
+		rf := CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
+		// the unchanged 128 byte tail matches the short last chunk,
+		// both chunks are copied with one range
 		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
-			file_level.A_BLOCK: 1,
-			file_level.B_BLOCK: 1,
+			file_level.A_BLOCK: 0,
+			file_level.B_BLOCK: 0,
+			file_level.R_BLOCK: 1,
 		})
 	})
 }
 
+func TestTrailingBlock(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "tail_rem.sync")
+	srcPath := path.Join(dir, "tail_src.sync")
+	resPath := path.Join(dir, "tail_res.sync")
+
+	rem := make([]byte, 3*file_level.CHUNK_SIZE+100)
+	mrand.New(mrand.NewSource(6)).Read(rem)
+	src := append([]byte(nil), rem...)
+	// change the second block, the short tail stays the same
+	src[file_level.CHUNK_SIZE+10] ^= 0xff
+	os.WriteFile(remPath, rem, 0644)
+	os.WriteFile(srcPath, src, 0644)
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	if last := rf.ChunkList[len(rf.ChunkList)-1]; last.Size != 100 {
+		t.Fatalf("last chunk has %d bytes, want 100", last.Size)
+	}
+
+	sf := CreateSourceFile(t, srcPath, file_level.DefaultSyncParams())
+	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	resp := Search(t, &ex)
+
+	last := resp[len(resp)-1]
+	if _, idx, err := last.ChunkRange(); err != nil || idx != uint64(len(rf.ChunkList)-1) {
+		t.Errorf("the tail was sent as %v", last.BlockType)
+	}
+
+	rf.WriteSyncedFile(&resp, resPath, false)
+	AssertSameContent(t, srcPath, resPath)
+}
+
+func TestRepeatedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "repeat_rem.sync")
+	srcPath := path.Join(dir, "repeat_src.sync")
+	resPath := path.Join(dir, "repeat_res.sync")
+
+	blockA := make([]byte, file_level.CHUNK_SIZE)
+	blockB := make([]byte, file_level.CHUNK_SIZE)
+	mrand.New(mrand.NewSource(7)).Read(blockB)
+
+	rem := bytes.Join([][]byte{blockA, blockB, blockA}, nil)
+	src := bytes.Join([][]byte{blockA, blockA, blockB, blockA, blockB, blockB}, nil)
+	os.WriteFile(remPath, rem, 0644)
+	os.WriteFile(srcPath, src, 0644)
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	sf := CreateSourceFile(t, srcPath, file_level.DefaultSyncParams())
+	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	resp := Search(t, &ex)
+
+	// every block is reused as many times as it appears,
+	// A, B, A is a range of the three chunks
+	AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+		file_level.A_BLOCK: 0,
+		file_level.B_BLOCK: 3,
+		file_level.R_BLOCK: 1,
+	})
+
+	rf.WriteSyncedFile(&resp, resPath, false)
+	AssertSameContent(t, srcPath, resPath)
+
+	// identical chunks are indexed once, an unchanged file is still a single range
+	rem = bytes.Join([][]byte{blockB, blockA, blockA, blockB, blockA, blockA}, nil)
+	os.WriteFile(remPath, rem, 0644)
+	os.WriteFile(srcPath, rem, 0644)
+
+	rf = CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	sf = CreateSourceFile(t, srcPath, file_level.DefaultSyncParams())
+	ex, _ = file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	resp = Search(t, &ex)
+
+	AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+		file_level.R_BLOCK: 1,
+	})
+	if first, last, err := resp[0].ChunkRange(); err != nil || first != 0 || last != 5 {
+		t.Errorf("got the range %d..%d, want 0..5", first, last)
+	}
+}
+
 func TestWriteFile(t *testing.T) {
 	t.Run("2 Chunk + 128 bytes", func(t *testing.T) {
 		const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
 		const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
 
-		rf := file_level.CreateRemoteFile(remPath)
-		sf := file_level.CreateSourceFile(hostPath)
+		rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+		sf := CreateSourceFile(t, hostPath, file_level.DefaultSyncParams())
 		ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
-		resp := ex.Search()
+		resp := Search(t, &ex)
 
 		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
-			file_level.A_BLOCK: 1,
-			file_level.B_BLOCK: 2,
+			file_level.A_BLOCK: 0,
+			file_level.B_BLOCK: 0,
+			file_level.R_BLOCK: 1,
 		})
 
 		rf.WriteSyncedFile(&resp, "test_data/writeFile/2_chunk_128_res.sync", false)
+		AssertSameContent(t, hostPath, "test_data/writeFile/2_chunk_128_res.sync")
 	})
 }
 
-func AssertPackageTypeByCount(t testing.TB, resp file_level.Response, wantMap map[file_level.ResponseType]int) {
-	t.Helper()
-	gotMap := map[file_level.ResponseType]int{
-		file_level.A_BLOCK: 0,
-		file_level.B_BLOCK: 0,
+func TestCloseVerified(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
+	basisPath := path.Join(t.TempDir(), "verified_rem.sync")
+	basis, err := os.ReadFile(remPath)
+	if err != nil {
+		t.Fatal(err)
 	}
+	os.WriteFile(basisPath, basis, 0644)
 
-	for _, pack := range resp {
-		gotMap[pack.BlockType]++
+	params := file_level.DefaultSyncParams()
+	fileSum, err := file_level.GetFileHash(hostPath, params.HashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for key, val := range wantMap {
-		if val != gotMap[key] {
-			t.Errorf(
-				"Search failed,\n"+
-					"received A : %d, B : %d\n"+
-					"wanted   A : %d, B : %d\n",
-				gotMap[file_level.A_BLOCK], gotMap[file_level.B_BLOCK],
-				wantMap[file_level.A_BLOCK], wantMap[file_level.B_BLOCK],
-			)
+	sync := func(fileSum []byte) error {
+		rf := CreateRemoteFile(t, basisPath, params)
+		sf := CreateSourceFile(t, hostPath, params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer, err := rf.NewSyncedFileWriter(basisPath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.SearchTo(writer); err != nil {
+			t.Fatal(err)
+		}
+		return writer.CloseVerified(params.HashAlgorithm, fileSum)
+	}
+
+	// a wrong hash stands for a false match, the basis has to stay as it was
+	wrongSum := append([]byte{fileSum[0] ^ 1}, fileSum[1:]...)
+	if err := sync(wrongSum); !errors.Is(err, file_level.ErrSyncedHash) {
+		t.Fatalf("got %v, want %v", err, file_level.ErrSyncedHash)
+	}
+	AssertSameContent(t, remPath, basisPath)
+	AssertNoTempFiles(t, path.Dir(basisPath), 1)
+
+	if err := sync(fileSum); err != nil {
+		t.Fatal(err)
+	}
+	AssertSameContent(t, hostPath, basisPath)
+
+	redo := file_level.SyncParams{BlockSize: 700, HashAlgorithm: file_level.HASH_XXH3}.Redo()
+	if redo.BlockSize != 350 || redo.HashAlgorithm != file_level.HASH_SHA256 {
+		t.Errorf("redo of 700 byte blocks with xxh3 is %+v", redo)
+	}
+	if redo := (file_level.SyncParams{BlockSize: file_level.MIN_BLOCK_SIZE}).Redo(); redo.BlockSize != file_level.MIN_BLOCK_SIZE {
+		t.Errorf("redo went below the smallest block size: %d", redo.BlockSize)
+	}
+}
+
+func TestAtomicReplace(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
+	dir := t.TempDir()
+	basisPath := path.Join(dir, "atomic_rem.sync")
+	basis, err := os.ReadFile(remPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(basisPath, basis, 0640)
+
+	params := file_level.DefaultSyncParams()
+	newWriter := func() (*file_level.SyncedFileWriter, file_level.RsyncExchange) {
+		rf := CreateRemoteFile(t, basisPath, params)
+		sf := CreateSourceFile(t, hostPath, params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer, err := rf.NewSyncedFileWriter(basisPath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writer, ex
+	}
+
+	// two syncs of the same destination do not share a temporary file
+	first, firstEx := newWriter()
+	second, secondEx := newWriter()
+	if err := firstEx.SearchTo(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondEx.SearchTo(second); err != nil {
+		t.Fatal(err)
+	}
+	AssertSameContent(t, remPath, basisPath)
+
+	second.Abort()
+	AssertSameContent(t, remPath, basisPath)
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSameContent(t, hostPath, basisPath)
+	AssertNoTempFiles(t, dir, 1)
+
+	stats, err := os.Stat(basisPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mode().Perm() != 0640 {
+		t.Errorf("the replaced file has mode %v, want %v", stats.Mode().Perm(), os.FileMode(0640))
+	}
+
+	// a failed check keeps the destination as it was
+	os.WriteFile(basisPath, basis, 0640)
+	writer, ex := newWriter()
+	if err := ex.SearchTo(writer); err != nil {
+		t.Fatal(err)
+	}
+	errCheck := errors.New("check failed")
+	if err := writer.CloseChecked(func(string) error { return errCheck }); !errors.Is(err, errCheck) {
+		t.Fatalf("got %v, want %v", err, errCheck)
+	}
+	AssertSameContent(t, remPath, basisPath)
+	AssertNoTempFiles(t, dir, 1)
+
+	// a missing directory fails before anything is written
+	if _, err := file_level.NewWholeFileWriter(path.Join(dir, "missing", "whole.sync"), params); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+}
+
+func TestBlockCopies(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := path.Join(dir, "copies_src.sync")
+	remPath := path.Join(dir, "copies_rem.sync")
+	resPath := path.Join(dir, "copies_res.sync")
+	r := mrand.New(mrand.NewSource(22))
+
+	basis := make([]byte, 64*4096+1000)
+	r.Read(basis)
+	insert := make([]byte, 4096)
+	r.Read(insert)
+	// aligned ranges can be cloned, the ones after the odd insert are copied
+	source := append(append(append([]byte(nil), basis[:8*4096]...), insert...), basis[8*4096:40*4096]...)
+	source = append(append(source, insert[:123]...), basis[40*4096:]...)
+	os.WriteFile(srcPath, source, 0644)
+	os.WriteFile(remPath, basis, 0644)
+
+	params := file_level.SyncParams{BlockSize: 4096, HashAlgorithm: file_level.HASH_SHA256}
+	rf := CreateRemoteFile(t, remPath, params)
+	sf := CreateSourceFile(t, srcPath, params)
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := rf.NewSyncedFileWriter(resPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SearchTo(w); err != nil {
+		w.Abort()
+		t.Fatal(err)
+	}
+	stats := w.CopyStats()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	AssertSameContent(t, srcPath, resPath)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("ranges are only cloned or copied by the kernel on Linux")
+	}
+	// every copy is from the basis, none goes through the buffer
+	if stats.Buffered != 0 || stats.Cloned+stats.FileCopied != uint64(len(basis)) {
+		t.Errorf("copy stats %+v, want %d bytes cloned or copied from file to file", stats, len(basis))
+	}
+	if unaligned := uint64(len(basis) - 40*4096); stats.FileCopied < unaligned {
+		t.Errorf("%d bytes copied from file to file, the %d after the odd insert can not be cloned", stats.FileCopied, unaligned)
+	}
+	if stats.Cloned == 0 {
+		t.Logf("no reflinks in %s, every range was copied, point TMPDIR to btrfs or XFS to clone them", dir)
+	}
+}
+
+// rewrites a file when it is opened for the nth time
+type changingFS struct {
+	file_level.FS
+	t        testing.TB
+	filePath string
+	nth      int
+	data     []byte
+	opens    int
+}
+
+func (cfs *changingFS) OpenFile(name string, flag int, perm fs.FileMode) (file_level.File, error) {
+	if name == cfs.filePath {
+		if cfs.opens++; cfs.opens == cfs.nth {
+			WriteFS(cfs.t, cfs.FS, name, cfs.data)
+		}
+	}
+	return cfs.FS.OpenFile(name, flag, perm)
+}
+
+func TestRedo(t *testing.T) {
+	r := mrand.New(mrand.NewSource(23))
+	rem := make([]byte, 64<<10)
+	r.Read(rem)
+	before := append(append([]byte(nil), rem[:30000]...), "edited before the hash"...)
+	after := append(append([]byte(nil), rem[:30000]...), "edited while it was read"...)
+
+	// serves a single connection, the error of the server side goes to the channel
+	serve := func(opts *options.ServerOptions) (string, <-chan error) {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error, 1)
+		go func() {
+			defer listener.Close()
+			conn, err := listener.Accept()
+			if err != nil {
+				served <- err
+				return
+			}
+			defer conn.Close()
+			served <- transport.InitSyncConn(conn).HandleConnection(opts)
+		}()
+		return listener.Addr().String(), served
+	}
+
+	for _, c := range []struct {
+		name       string
+		maxRedo    int
+		wantClient error
+		wantServer error
+	}{
+		{"Source changed while it was read", 2, nil, nil},
+		{"Redo limit", 0, transport.ErrSyncFailed, transport.ErrRedoLimit},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverFS, clientFS := file_level.NewMemFS(), file_level.NewMemFS()
+			WriteFS(t, serverFS, "dest.sync", rem)
+			WriteFS(t, clientFS, "src.sync", before)
+
+			addr, served := serve(&options.ServerOptions{MaxRedo: c.maxRedo, FS: serverFS})
+			opts := options.Options{
+				Source: options.AddressPath{Filepath: "src.sync"},
+				Dest:   options.AddressPath{Address: addr, Filepath: "dest.sync"},
+				// the first open hashes the source, it changes before the second one reads it
+				FS: &changingFS{FS: clientFS, t: t, filePath: "src.sync", nth: 2, data: after},
+			}
+
+			if err := transport.SendFile(&opts); !errors.Is(err, c.wantClient) {
+				t.Errorf("client: got %v, want %v", err, c.wantClient)
+			}
+			if err := <-served; !errors.Is(err, c.wantServer) {
+				t.Errorf("server: got %v, want %v", err, c.wantServer)
+			}
+
+			want := after
+			if c.wantServer != nil {
+				// a result that never matched does not replace the destination
+				want = rem
+			}
+			if got := ReadFS(t, serverFS, "dest.sync"); !bytes.Equal(got, want) {
+				t.Errorf("destination has %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// requests the server has to refuse before it looks at the destination
+func TestHandshake(t *testing.T) {
+	// MD5 is only allowed when the server names it
+	if (&options.ServerOptions{}).AllowsHash(file_level.HASH_MD5) {
+		t.Errorf("md5 is allowed by default")
+	}
+	if !(&options.ServerOptions{AllowedHashes: []string{"md5"}}).AllowsHash(file_level.HASH_MD5) {
+		t.Errorf("md5 is not allowed when it is named")
+	}
+
+	sha256Sum := make([]byte, 32)
+	for _, c := range []struct {
+		name    string
+		request transport.InitialFileRequest
+		want    error
+	}{
+		{"MD4", transport.InitialFileRequest{HashAlgorithm: file_level.HASH_MD4, FileSum: make([]byte, 16)},
+			file_level.ErrUnknownHash},
+		{"MD5", transport.InitialFileRequest{HashAlgorithm: file_level.HASH_MD5, FileSum: make([]byte, 16)},
+			transport.ErrHashNotAllowed},
+		{"No file hash", transport.InitialFileRequest{HashAlgorithm: file_level.HASH_SHA256},
+			transport.ErrFileSum},
+		{"Short file hash", transport.InitialFileRequest{HashAlgorithm: file_level.HASH_SHA256, FileSum: sha256Sum[:16]},
+			transport.ErrFileSum},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			served := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				served <- transport.InitSyncConn(server).HandleConnection(&options.ServerOptions{FS: file_level.NewMemFS()})
+			}()
+
+			conn := transport.InitSyncConn(client)
+			c.request.Filename = "dest.sync"
+			if err := conn.Encode(c.request); err != nil {
+				t.Fatal(err)
+			}
+			var statusMsg transport.StatusMessages
+			if err := conn.Decode(&statusMsg); err != nil {
+				t.Fatal(err)
+			}
+			if statusMsg.Status != transport.STATUS_SERVER_ERROR {
+				t.Errorf("got %v, want %v", statusMsg.Status, transport.STATUS_SERVER_ERROR)
+			}
+			if err := <-served; !errors.Is(err, c.want) {
+				t.Errorf("server: got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
+	dir := t.TempDir()
+	missing := path.Join(dir, "missing.sync")
+
+	if _, err := file_level.CreateRemoteFile(missing); !errors.Is(err, file_level.ErrMissingBasis) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("remote file: got %v, want %v", err, file_level.ErrMissingBasis)
+	}
+	if _, err := file_level.CreateSourceFile(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source file: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	basisPath := path.Join(dir, "typed_rem.sync")
+	basis, err := os.ReadFile(remPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(basisPath, basis, 0644)
+	rf := CreateRemoteFile(t, basisPath, file_level.DefaultSyncParams())
+	sf := CreateSourceFile(t, hostPath, file_level.DefaultSyncParams())
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := Search(t, &ex)
+
+	outOfRange := file_level.Response{{BlockType: file_level.B_BLOCK, Data: binary.LittleEndian.AppendUint64(nil, rf.ChunkCount)}}
+	if err := rf.WriteSyncedFile(&outOfRange, path.Join(dir, "typed_res.sync"), false); !errors.Is(err, file_level.ErrChunkIndex) {
+		t.Errorf("chunk out of range: got %v, want %v", err, file_level.ErrChunkIndex)
+	}
+
+	// the basis changed after its signatures were sent
+	os.WriteFile(basisPath, basis[:len(basis)/2], 0644)
+	if err := rf.WriteSyncedFile(&resp, path.Join(dir, "typed_res.sync"), false); !errors.Is(err, file_level.ErrShortRead) {
+		t.Errorf("truncated basis: got %v, want %v", err, file_level.ErrShortRead)
+	}
+
+	os.Remove(basisPath)
+	if _, err := rf.NewSyncedFileWriter(basisPath, true); !errors.Is(err, file_level.ErrMissingBasis) {
+		t.Errorf("removed basis: got %v, want %v", err, file_level.ErrMissingBasis)
+	}
+	AssertNoTempFiles(t, dir, 0)
+
+	var opts options.Options
+	if err := opts.ParseArgument([]string{hostPath, "host:a:b"}); !errors.Is(err, options.ErrInvalidAddress) {
+		t.Errorf("address: got %v, want %v", err, options.ErrInvalidAddress)
+	}
+}
+
+func TestReaders(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "readers_rem.sync")
+	r := mrand.New(mrand.NewSource(21))
+
+	rem := make([]byte, 200<<10+31)
+	repeated := make([]byte, 20000)
+	r.Read(rem)
+	r.Read(repeated)
+	src := bytes.Join([][]byte{rem[:50000], repeated, rem[60000:150000], repeated, rem[150000:]}, nil)
+	os.WriteFile(remPath, rem, 0644)
+
+	for _, chunking := range []file_level.ChunkingMode{file_level.CHUNKING_FIXED, file_level.CHUNKING_CDC} {
+		params := file_level.DefaultSyncParams()
+		params.BlockSize = 1024
+		params.Chunking = chunking
+
+		rf, err := file_level.NewRemoteFileStream(bytes.NewReader(rem), int64(len(rem)), params, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := CreateRemoteFile(t, remPath, params); !cmp.Equal(want.ChunkList, rf.ChunkList) {
+			t.Errorf("%v: chunk list of a reader differs from the one of its file", chunking)
+		}
+
+		sources := map[string]func() (file_level.SourceFile, error){
+			// hides io.ReaderAt, the source can only be read once
+			"stream": func() (file_level.SourceFile, error) {
+				return file_level.NewSourceFile(struct{ io.Reader }{bytes.NewReader(src)}, params)
+			},
+			"reader at": func() (file_level.SourceFile, error) {
+				return file_level.NewSourceFileAt(bytes.NewReader(src), int64(len(src)), params)
+			},
+		}
+		for name, newSource := range sources {
+			sf, err := newSource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.Workers = 4
+			resp := Search(t, &ex)
+
+			var out bytes.Buffer
+			if err := rf.WriteSynced(&resp, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), src) {
+				t.Errorf("%v %s: synced output differs from the source", chunking, name)
+			}
+
+			whole, err := newSource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wholeResp file_level.Response
+			if err := whole.WholeFileTo(&wholeResp); err != nil {
+				t.Fatal(err)
+			}
+			out.Reset()
+			if err := rf.WriteSynced(&wholeResp, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), src) {
+				t.Errorf("%v %s: whole file output differs from the source", chunking, name)
+			}
+		}
+	}
+
+	params := file_level.DefaultSyncParams()
+	params.BlockSize = 1024
+	rf, err := file_level.NewRemoteFile(bytes.NewReader(rem), int64(len(rem)), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Basis compression of a stream", func(t *testing.T) {
+		sf, err := file_level.NewSourceFile(bytes.NewBuffer(src), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp file_level.Response
+		if _, err := ex.NewBasisCompressSink(&resp, file_level.DEFAULT_COMPRESS_LEVEL); !errors.Is(err, file_level.ErrNoRandomAccess) {
+			t.Errorf("got %v, want %v", err, file_level.ErrNoRandomAccess)
+		}
+	})
+
+	t.Run("Self references", func(t *testing.T) {
+		sf, err := file_level.NewSourceFileAt(bytes.NewReader(src), int64(len(src)), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.SelfRefs = true
+		resp := Search(t, &ex)
+
+		// the output is read back for the copies
+		if err := rf.WriteSynced(&resp, &bytes.Buffer{}); !errors.Is(err, file_level.ErrNoRandomAccess) {
+			t.Errorf("got %v, want %v", err, file_level.ErrNoRandomAccess)
+		}
+
+		outPath := path.Join(dir, "readers_self.sync")
+		out, err := os.OpenFile(outPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if err := rf.WriteSynced(&resp, out); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(outPath)
+		if !bytes.Equal(got, src) {
+			t.Error("synced output differs from the source")
+		}
+	})
+}
+
+func TestFileSystems(t *testing.T) {
+	r := mrand.New(mrand.NewSource(22))
+	rem := make([]byte, 100<<10+7)
+	noise := make([]byte, 5000)
+	r.Read(rem)
+	r.Read(noise)
+	src := bytes.Join([][]byte{rem[:40000], noise, rem[45000:]}, nil)
+
+	params := file_level.DefaultSyncParams()
+	params.BlockSize = 1024
+
+	// a delta sync of dir/rem.sync from dir/src.sync, all on fsys
+	syncFS := func(t *testing.T, fsys file_level.FS, inPlace bool) {
+		t.Helper()
+		rf, err := file_level.CreateRemoteFileStreamFS(fsys, "dir/rem.sync", params, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := file_level.CreateSourceFileFS(fsys, "dir/src.sync", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sf.File.Close()
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.InPlace = inPlace
+
+		var writer *file_level.SyncedFileWriter
+		if inPlace {
+			writer, err = rf.NewInPlaceWriter()
+		} else {
+			writer, err = rf.NewSyncedFileWriter("dir/rem.sync", true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.SearchTo(writer); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := file_level.GetFileHashFS(fsys, "dir/src.sync", params.HashAlgorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.CloseVerified(params.HashAlgorithm, sum); err != nil {
+			t.Fatal(err)
+		}
+		if got := ReadFS(t, fsys, "dir/rem.sync"); !bytes.Equal(got, src) {
+			t.Error("synced file differs from the source")
+		}
+	}
+
+	newMemFS := func(t *testing.T) *file_level.MemFS {
+		mfs := file_level.NewMemFS()
+		if err := mfs.MkdirAll("dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		WriteFS(t, mfs, "dir/rem.sync", rem)
+		WriteFS(t, mfs, "dir/src.sync", src)
+		return mfs
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		for _, inPlace := range []bool{false, true} {
+			mfs := newMemFS(t)
+			syncFS(t, mfs, inPlace)
+			if names, _ := mfs.ReadDir("dir"); !cmp.Equal(names, []string{"rem.sync", "src.sync"}) {
+				t.Errorf("in place %v: files left in dir: %v", inPlace, names)
+			}
+		}
+
+		mfs := newMemFS(t)
+		_, err := file_level.CreateRemoteFileStreamFS(mfs, "dir/missing.sync", params, 1, nil)
+		if !errors.Is(err, file_level.ErrMissingBasis) || !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("missing basis: got %v", err)
+		}
+
+		writer, err := file_level.NewWholeFileWriterFS(mfs, "dir/whole.sync", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range []file_level.ResponsePacket{
+			{BlockType: file_level.A_BLOCK, Data: []byte("head")},
+			{BlockType: file_level.H_BLOCK, Data: binary.LittleEndian.AppendUint64(nil, 3000)},
+		} {
+			if err := writer.WritePacket(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := ReadFS(t, mfs, "dir/whole.sync"); !bytes.Equal(got, append([]byte("head"), make([]byte, 3000)...)) {
+			t.Errorf("whole file is %d bytes", len(got))
+		}
+	})
+
+	t.Run("Subtree", func(t *testing.T) {
+		dir := t.TempDir()
+		os.MkdirAll(path.Join(dir, "root/dir"), 0755)
+		os.WriteFile(path.Join(dir, "root/dir/rem.sync"), rem, 0644)
+		os.WriteFile(path.Join(dir, "root/dir/src.sync"), src, 0644)
+		sub := file_level.SubFS(file_level.OSFS{}, path.Join(dir, "root"))
+
+		syncFS(t, sub, false)
+		AssertNoTempFiles(t, path.Join(dir, "root/dir"), 2)
+
+		// ".." stops at the root of the subtree
+		if err := sub.MkdirAll("../../out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path.Join(dir, "root/out")); err != nil {
+			t.Errorf("directory outside the subtree: %v", err)
+		}
+		_, err := sub.Stat("dir/missing.sync")
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) || pathErr.Path != "dir/missing.sync" {
+			t.Errorf("error names the real path: %v", err)
+		}
+
+		mfs := newMemFS(t)
+		if got := ReadFS(t, file_level.SubFS(mfs, "dir"), "/../src.sync"); !bytes.Equal(got, src) {
+			t.Error("subtree of a MemFS reads the wrong file")
+		}
+	})
+
+	t.Run("Transport", func(t *testing.T) {
+		serverFS, clientFS := file_level.NewMemFS(), file_level.NewMemFS()
+		WriteFS(t, clientFS, "src.sync", src)
+		serverFS.MkdirAll("dest", 0755)
+		WriteFS(t, serverFS, "dest/rem.sync", rem)
+
+		serv, err := transport.StartServer(&options.ServerOptions{FS: serverFS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serv.Run()
+
+		for _, destPath := range []string{"dest/rem.sync", "dest/new/whole.sync"} {
+			opts := options.Options{
+				Source: options.AddressPath{Filepath: "src.sync"},
+				Dest:   options.AddressPath{Address: serv.Listner.Addr().String(), Filepath: destPath},
+				FS:     clientFS,
+			}
+			if err := transport.SendFile(&opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := ReadFS(t, serverFS, destPath); !bytes.Equal(got, src) {
+				t.Errorf("%s differs from the source", destPath)
+			}
 		}
+	})
+}
+
+func TestStreamingSearch(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
+	resPath := path.Join(t.TempDir(), "2_chunk_128_res.sync")
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	sf := CreateSourceFile(t, hostPath, file_level.DefaultSyncParams())
+	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+
+	writer, err := rf.NewSyncedFileWriter(resPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SearchTo(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	AssertSameContent(t, hostPath, resPath)
+}
+
+func TestStreamingSignatures(t *testing.T) {
+	const default_path_src = "test_data/typeB/128_block_src.sync"
+	const default_path_rem = "test_data/typeB/128_block_rem.sync"
+	params := file_level.SyncParams{BlockSize: file_level.MIN_BLOCK_SIZE}
+
+	stream := file_level.NewChunkStream()
+	go func() {
+		_, err := file_level.CreateRemoteFileStream(default_path_rem, params, 1, func(batch []file_level.Chunk) error {
+			stream.Add(batch)
+			return nil
+		})
+		stream.Close(err)
+	}()
+
+	sf := CreateSourceFile(t, default_path_src, params)
+	ex, err := file_level.CreateStreamingRsyncExchange(&sf, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every chunk has to be found even if its batch arrives late,
+	// so the whole file is a single range
+	AssertPackageTypeByCount(t, Search(t, &ex), map[file_level.ResponseType]int{
+		file_level.A_BLOCK: 0,
+		file_level.B_BLOCK: 0,
+		file_level.R_BLOCK: 1,
+	})
+}
+
+func TestParallelSignatures(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "parallel_rem.sync")
+	data := make([]byte, 3<<20+123)
+	mrand.New(mrand.NewSource(8)).Read(data)
+	os.WriteFile(filePath, data, 0644)
+
+	for _, chunking := range []file_level.ChunkingMode{file_level.CHUNKING_FIXED, file_level.CHUNKING_CDC} {
+		params := file_level.DefaultSyncParams()
+		params.BlockSize = 1024
+		params.Chunking = chunking
+
+		want := CreateRemoteFile(t, filePath, params)
+
+		var batches [][]file_level.Chunk
+		got, err := file_level.CreateRemoteFileStream(filePath, params, 4, func(batch []file_level.Chunk) error {
+			batches = append(batches, batch)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !cmp.Equal(want.ChunkList, got.ChunkList) {
+			t.Errorf("%v: parallel chunk list differs from the sequential one", chunking)
+		}
+
+		var streamed []file_level.Chunk
+		for _, batch := range batches {
+			streamed = append(streamed, batch...)
+		}
+		if !cmp.Equal(want.ChunkList, streamed) {
+			t.Errorf("%v: batches are not in index order", chunking)
+		}
+
+		// a read error half way must not leave a shorter chunk list
+		basis := failingReaderAt{bytes.NewReader(data), int64(len(data) / 2)}
+		for _, workers := range []int{1, 4} {
+			_, err := file_level.NewRemoteFileStream(basis, int64(len(data)), params, workers, nil)
+			if !errors.Is(err, errFailingRead) {
+				t.Errorf("%v with %d workers: got %v, want %v", chunking, workers, err, errFailingRead)
+			}
+		}
+	}
+}
+
+var errFailingRead = errors.New("read failed")
+
+// fails every read that reaches past failAt
+type failingReaderAt struct {
+	io.ReaderAt
+	failAt int64
+}
+
+func (r failingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > r.failAt {
+		return 0, errFailingRead
+	}
+	return r.ReaderAt.ReadAt(p, offset)
+}
+
+func TestParallelSearch(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "parallel_search_rem.sync")
+	srcPath := path.Join(dir, "parallel_search_src.sync")
+	r := mrand.New(mrand.NewSource(9))
+
+	remote := make([]byte, 1<<20+77)
+	r.Read(remote)
+
+	// edits and repeated blocks, so matches cross region boundaries
+	source := append([]byte(nil), remote[:300000]...)
+	source = append(source, remote[5000:90000]...)
+	noise := make([]byte, 12345)
+	r.Read(noise)
+	source = append(source, noise...)
+	source = append(source, remote[400001:]...)
+	source = append(source, remote[:4096]...)
+	source = append(source, remote[len(remote)-77:]...)
+	os.WriteFile(remPath, remote, 0644)
+	os.WriteFile(srcPath, source, 0644)
+
+	for _, blockSize := range []uint64{64, 1000, 4096} {
+		params := file_level.DefaultSyncParams()
+		params.BlockSize = blockSize
+		rf := CreateRemoteFile(t, remPath, params)
+
+		search := func(workers int) file_level.Response {
+			sf := CreateSourceFile(t, srcPath, params)
+			ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.Workers = workers
+			return Search(t, &ex)
+		}
+
+		want := search(1)
+		got := search(4)
+		if !cmp.Equal(want, got) {
+			t.Errorf("block size %d: parallel delta differs from the sequential one", blockSize)
+		}
+
+		outPath := path.Join(dir, fmt.Sprintf("parallel_search_%d.sync", blockSize))
+		rf.WriteSyncedFile(&got, outPath, false)
+		AssertSameContent(t, srcPath, outPath)
+	}
+}
+
+// the search has to start on the chunks of a stream before it is done,
+// also when it hands the rest of the source to the parallel search.
+// Literals are not sent before the stream is done, a chunk still
+// to come could match them
+func TestStreamingOverlap(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "overlap_rem.sync")
+	srcPath := path.Join(dir, "overlap_src.sync")
+	r := mrand.New(mrand.NewSource(27))
+
+	const blockSize = 1024
+	remote := make([]byte, 64*blockSize)
+	r.Read(remote)
+	noise := make([]byte, 3000)
+	r.Read(noise)
+	os.WriteFile(remPath, remote, 0644)
+
+	params := file_level.DefaultSyncParams()
+	params.BlockSize = blockSize
+	rf := CreateRemoteFile(t, remPath, params)
+
+	sources := []struct {
+		name   string
+		source []byte
+		// sent before the second half of the chunks
+		earlyLiteral bool
+	}{
+		// the repeated blocks are out of order, so the range before them
+		// is sent while the stream only has the first half of the chunks,
+		// the literal is past that half and waits for the rest
+		{"late literal", bytes.Join([][]byte{remote[:32*blockSize], remote[8*blockSize : 16*blockSize],
+			noise, remote[32*blockSize:]}, nil), false},
+		// the literal is within the first half, it is sent right away
+		{"early literal", bytes.Join([][]byte{remote[:16*blockSize], noise,
+			remote[16*blockSize:]}, nil), true},
+	}
+
+	for _, c := range sources {
+		os.WriteFile(srcPath, c.source, 0644)
+		sf := CreateSourceFile(t, srcPath, params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Search(t, &ex)
+
+		for _, workers := range []int{1, 4} {
+			stream := file_level.NewChunkStream()
+			sf := CreateSourceFile(t, srcPath, params)
+			ex, err := file_level.CreateStreamingRsyncExchange(&sf, stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.Workers = workers
+
+			sink := &notifySink{first: make(chan struct{}), literal: make(chan struct{})}
+			searched := make(chan error, 1)
+			go func() {
+				searched <- ex.SearchTo(sink)
+			}()
+
+			stream.Add(rf.ChunkList[:32])
+			wait, what := sink.first, "nothing"
+			if c.earlyLiteral {
+				wait, what = sink.literal, "no literal"
+			}
+			select {
+			case <-wait:
+			case <-time.After(10 * time.Second):
+				stream.Close(nil)
+				<-searched
+				t.Fatalf("%s, %d workers: %s was sent before the stream was done", c.name, workers, what)
+			}
+
+			sink.streamDone.Store(true)
+			stream.Add(rf.ChunkList[32:])
+			stream.Close(nil)
+			if err := <-searched; err != nil {
+				t.Fatal(err)
+			}
+			if sink.earlyLiteral != c.earlyLiteral {
+				t.Errorf("%s, %d workers: literal sent before the stream was done: %v, want %v",
+					c.name, workers, sink.earlyLiteral, c.earlyLiteral)
+			}
+			if !cmp.Equal(want, sink.Response) {
+				t.Errorf("%s, %d workers: streaming delta differs from the sequential one", c.name, workers)
+			}
+		}
+	}
+}
+
+// collects the packets of a search running in another goroutine,
+// first is closed when the first one arrives, literal with the first literal
+type notifySink struct {
+	file_level.Response
+	first   chan struct{}
+	literal chan struct{}
+
+	// set before the stream is closed
+	streamDone   atomic.Bool
+	earlyLiteral bool
+}
+
+func (sink *notifySink) WritePacket(packet file_level.ResponsePacket) error {
+	if len(sink.Response) == 0 {
+		close(sink.first)
+	}
+	if packet.BlockType == file_level.A_BLOCK && !sink.streamDone.Load() {
+		if !sink.earlyLiteral {
+			close(sink.literal)
+		}
+		sink.earlyLiteral = true
+	}
+	sink.Response = append(sink.Response, packet)
+	return nil
+}
+
+func TestInPlace(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := path.Join(dir, "inplace_src.sync")
+	remPath := path.Join(dir, "inplace_rem.sync")
+	r := mrand.New(mrand.NewSource(19))
+
+	basis := make([]byte, 200*512+100)
+	r.Read(basis)
+	// identical zero blocks are indexed once, the copy at the right place has to be found
+	copy(basis[20*512:30*512], make([]byte, 10*512))
+	copy(basis[100*512:110*512], make([]byte, 10*512))
+
+	noise := make([]byte, 3000)
+	r.Read(noise)
+	edited := append([]byte(nil), basis...)
+	edited[60000] ^= 0xff
+	// only the copy of the zero blocks after them is still intact
+	zeros := append([]byte(nil), basis...)
+	copy(zeros[60*512:65*512], make([]byte, 5*512))
+
+	sources := map[string][]byte{
+		// data moved towards the start can be copied, data moved towards the end can not
+		"moved": append(append(append(append([]byte(nil), basis[50000:80000]...), basis[:50000]...),
+			noise...), basis[80000:]...),
+		"edited":  edited,
+		"zeros":   zeros,
+		"shorter": basis[:70000],
+	}
+
+	for name, source := range sources {
+		os.WriteFile(srcPath, source, 0644)
+
+		for _, mode := range []struct {
+			name     string
+			chunking file_level.ChunkingMode
+			workers  int
+			selfRefs bool
+		}{
+			{"sequential", file_level.CHUNKING_FIXED, 1, false},
+			{"parallel", file_level.CHUNKING_FIXED, 4, false},
+			{"self refs", file_level.CHUNKING_FIXED, 1, true},
+			{"cdc", file_level.CHUNKING_CDC, 1, false},
+		} {
+			os.WriteFile(remPath, basis, 0644)
+			params := file_level.SyncParams{BlockSize: 512, HashAlgorithm: file_level.HASH_SHA256, Chunking: mode.chunking}
+
+			rf := CreateRemoteFile(t, remPath, params)
+			sf := CreateSourceFile(t, srcPath, params)
+			ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.Workers = mode.workers
+			ex.SelfRefs = mode.selfRefs
+			ex.InPlace = true
+
+			writer, err := rf.NewInPlaceWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp file_level.Response
+			if err := ex.SearchTo(&resp); err != nil {
+				t.Fatal(err)
+			}
+			var literal int
+			for _, packet := range resp {
+				if packet.BlockType == file_level.A_BLOCK {
+					literal += len(packet.Data)
+				}
+				if err := writer.WritePacket(packet); err != nil {
+					t.Fatalf("%s %s: %v", name, mode.name, err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			AssertSameContent(t, srcPath, remPath)
+
+			if name == "edited" && mode.chunking == file_level.CHUNKING_FIXED && literal > 512 {
+				t.Errorf("%s %s: %d literal bytes for a single changed byte", name, mode.name, literal)
+			}
+			if name == "zeros" && mode.chunking == file_level.CHUNKING_FIXED && literal > 0 {
+				t.Errorf("%s %s: %d literal bytes for blocks the basis still has", name, mode.name, literal)
+			}
+		}
+	}
+
+	// without InPlace the search copies from data the writer already overwrote
+	os.WriteFile(srcPath, sources["moved"], 0644)
+	os.WriteFile(remPath, basis, 0644)
+	params := file_level.SyncParams{BlockSize: 512, HashAlgorithm: file_level.HASH_SHA256}
+	rf := CreateRemoteFile(t, remPath, params)
+	sf := CreateSourceFile(t, srcPath, params)
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := rf.NewInPlaceWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Abort()
+	if err := ex.SearchTo(writer); !errors.Is(err, file_level.ErrInPlaceOrder) {
+		t.Errorf("got %v, want %v", err, file_level.ErrInPlaceOrder)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := path.Join(dir, "sparse_src.sync")
+	remPath := path.Join(dir, "sparse_rem.sync")
+	resPath := path.Join(dir, "sparse_res.sync")
+	r := mrand.New(mrand.NewSource(21))
+
+	// data, a hole, data and a trailing hole
+	writeSparse := func(filePath string, data []byte) {
+		file, err := os.Create(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		for _, region := range [][2]int{{0, 20000}, {1 << 20, 1<<20 + 30000}} {
+			if _, err := file.WriteAt(data[region[0]:region[1]], int64(region[0])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := file.Truncate(int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	basis := make([]byte, 3<<20)
+	r.Read(basis[:20000])
+	r.Read(basis[1<<20 : 1<<20+30000])
+	source := append([]byte(nil), basis...)
+	source[100] ^= 0xff
+	// zeros in the middle of literal data
+	copy(source[10000:18000], make([]byte, 8000))
+	writeSparse(remPath, basis)
+	writeSparse(srcPath, source)
+
+	params := file_level.SyncParams{BlockSize: 4096, HashAlgorithm: file_level.HASH_SHA256}
+	dense := path.Join(dir, "dense_rem.sync")
+	os.WriteFile(dense, basis, 0644)
+	want := CreateRemoteFile(t, dense, params)
+	for _, workers := range []int{1, 4} {
+		// chunks in holes are not read, they still have the sums of zeros
+		rf, err := file_level.CreateRemoteFileStream(remPath, params, workers, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want.ChunkList, rf.ChunkList); diff != "" {
+			t.Errorf("%d workers, chunks of the sparse basis differ (-want +got):\n%s", workers, diff)
+		}
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		rf := CreateRemoteFile(t, remPath, params)
+		sf := CreateSourceFile(t, srcPath, params)
+		sf.Sparse = true
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp file_level.Response
+		if err := ex.SearchTo(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var zeros uint64
+		for _, packet := range resp {
+			if packet.BlockType == file_level.H_BLOCK {
+				size, err := packet.ZeroRun()
+				if err != nil {
+					t.Fatal(err)
+				}
+				zeros += size
+			}
+			if packet.BlockType == file_level.A_BLOCK && bytes.Contains(packet.Data, make([]byte, file_level.SPARSE_MIN_RUN)) {
+				t.Errorf("the zeros of a literal were sent in %d bytes of data", len(packet.Data))
+			}
+		}
+		if zeros < uint64(len(basis))-60000 {
+			t.Errorf("%d bytes of zeros sent as zero runs", zeros)
+		}
+
+		if err := rf.WriteSyncedFile(&resp, resPath, false); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, srcPath, resPath)
+		AssertSparse(t, resPath)
+	})
+
+	t.Run("whole file", func(t *testing.T) {
+		sf := CreateSourceFile(t, srcPath, params)
+		sf.Sparse = true
+		writer, err := file_level.NewWholeFileWriter(resPath, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sf.WholeFileTo(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, srcPath, resPath)
+	})
+
+	t.Run("self references", func(t *testing.T) {
+		// the first block of zeros becomes a hole at the end of what is
+		// written so far, the next ones are copies of it
+		selfSrc := make([]byte, 30000)
+		r.Read(selfSrc[:5000])
+		r.Read(selfSrc[25000:])
+		selfPath := path.Join(dir, "sparse_self_src.sync")
+		os.WriteFile(selfPath, selfSrc, 0644)
+		// no zeros in the basis, they could only be copied from the output
+		selfRem := make([]byte, 30000)
+		r.Read(selfRem)
+		selfRemPath := path.Join(dir, "sparse_self_rem.sync")
+		os.WriteFile(selfRemPath, selfRem, 0644)
+
+		rf := CreateRemoteFile(t, selfRemPath, params)
+		sf := CreateSourceFile(t, selfPath, params)
+		sf.Sparse = true
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.SelfRefs = true
+		var resp file_level.Response
+		if err := ex.SearchTo(&resp); err != nil {
+			t.Fatal(err)
+		}
+		// zero bytes of the random data do not split its literals
+		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+			file_level.A_BLOCK: 4,
+			file_level.S_BLOCK: 3,
+			file_level.H_BLOCK: 1,
+		})
+
+		if err := rf.WriteSyncedFile(&resp, resPath, false); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, selfPath, resPath)
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		// zero runs have to overwrite what the basis had there
+		full := make([]byte, len(source))
+		r.Read(full)
+		os.WriteFile(resPath, full, 0644)
+
+		rf := CreateRemoteFile(t, resPath, params)
+		sf := CreateSourceFile(t, srcPath, params)
+		sf.Sparse = true
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.InPlace = true
+		writer, err := rf.NewInPlaceWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.SearchTo(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, srcPath, resPath)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "compress_rem.sync")
+	srcPath := path.Join(dir, "compress_src.sync")
+
+	var text bytes.Buffer
+	for idx := 0; text.Len() < 64<<10; idx++ {
+		fmt.Fprintf(&text, "%d: the quick brown fox jumps over the lazy dog\n", idx)
+	}
+	random := make([]byte, 8192)
+	mrand.New(mrand.NewSource(10)).Read(random)
+
+	os.WriteFile(remPath, text.Bytes()[:16<<10], 0644)
+	os.WriteFile(srcPath, append(text.Bytes(), random...), 0644)
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	sf := CreateSourceFile(t, srcPath, file_level.DefaultSyncParams())
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp file_level.Response
+	sink, err := file_level.NewCompressSink(&resp, file_level.DEFAULT_COMPRESS_LEVEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SearchTo(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	// the text compresses, the random bytes are left alone
+	AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+		file_level.A_BLOCK: 3,
+		file_level.R_BLOCK: 1,
+		file_level.Z_BLOCK: 12,
+	})
+
+	resPath := path.Join(dir, "compress_res.sync")
+	if err := rf.WriteSyncedFile(&resp, resPath, false); err != nil {
+		t.Fatal(err)
+	}
+	AssertSameContent(t, srcPath, resPath)
+
+	for _, level := range []int{-1, 10} {
+		if _, err := file_level.NewCompressSink(&resp, level); err == nil {
+			t.Errorf("level %d accepted", level)
+		}
+	}
+}
+
+func TestBasisCompression(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "basis_rem.sync")
+	srcPath := path.Join(dir, "basis_src.sync")
+
+	// 4 KB records made of the same few hundred lines,
+	// the source changes the timestamp of every third one
+	r := mrand.New(mrand.NewSource(11))
+	lines := make([][]byte, 300)
+	for idx := range lines {
+		lines[idx] = make([]byte, 40)
+		for pos := range lines[idx] {
+			lines[idx][pos] = "abcdefghijklmnop"[r.Intn(16)]
+		}
+	}
+
+	var remote, source bytes.Buffer
+	for idx := 0; idx < 64; idx++ {
+		var record []byte
+		for len(record) < 4096 {
+			record = append(record, lines[r.Intn(len(lines))]...)
+		}
+		record = record[:4096]
+		copy(record, fmt.Sprintf("record %04d at 2023-01-01T00:00:00", idx))
+		remote.Write(record)
+
+		if idx%3 == 1 {
+			copy(record, fmt.Sprintf("record %04d at 2024-06-15T12:34:56", idx))
+		}
+		source.Write(record)
+	}
+	os.WriteFile(remPath, remote.Bytes(), 0644)
+	os.WriteFile(srcPath, source.Bytes(), 0644)
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	deltaSize := func(basis bool) (file_level.Response, int) {
+		sf := CreateSourceFile(t, srcPath, file_level.DefaultSyncParams())
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var resp file_level.Response
+		var sink *file_level.CompressSink
+		if basis {
+			sink, err = ex.NewBasisCompressSink(&resp, file_level.DEFAULT_COMPRESS_LEVEL)
+		} else {
+			sink, err = file_level.NewCompressSink(&resp, file_level.DEFAULT_COMPRESS_LEVEL)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.SearchTo(sink); err != nil {
+			t.Fatal(err)
+		}
+
+		size := 0
+		for _, packet := range resp {
+			size += len(packet.Data)
+		}
+		return resp, size
+	}
+
+	plain, plainSize := deltaSize(false)
+	primed, primedSize := deltaSize(true)
+
+	// every changed record but the first follows a match
+	AssertPackageTypeByCount(t, primed, map[file_level.ResponseType]int{
+		file_level.B_BLOCK: 1,
+		file_level.R_BLOCK: 21,
+		file_level.D_BLOCK: 21,
+	})
+	if primedSize*2 > plainSize {
+		t.Errorf("basis dictionary delta is %d bytes, plain compression %d", primedSize, plainSize)
+	}
+
+	for name, resp := range map[string]file_level.Response{"plain": plain, "primed": primed} {
+		resPath := path.Join(dir, name+"_res.sync")
+		if err := rf.WriteSyncedFile(&resp, resPath, false); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, srcPath, resPath)
+	}
+}
+
+func TestRangePackets(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "range_rem.sync")
+	srcPath := path.Join(dir, "range_src.sync")
+	resPath := path.Join(dir, "range_res.sync")
+
+	params := file_level.DefaultSyncParams()
+	params.BlockSize = 1024
+
+	rem := make([]byte, 1000*params.BlockSize)
+	mrand.New(mrand.NewSource(12)).Read(rem)
+	src := append([]byte(nil), rem...)
+	src[300*params.BlockSize+5] ^= 0xff
+	src[700*params.BlockSize+5] ^= 0xff
+	os.WriteFile(remPath, rem, 0644)
+	os.WriteFile(srcPath, src, 0644)
+
+	rf := CreateRemoteFile(t, remPath, params)
+	sf := CreateSourceFile(t, srcPath, params)
+	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	resp := Search(t, &ex)
+
+	want := [][2]uint64{{0, 299}, {301, 699}, {701, 999}}
+	var got [][2]uint64
+	for _, packet := range resp {
+		if packet.BlockType == file_level.A_BLOCK {
+			continue
+		}
+		first, last, err := packet.ChunkRange()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, [2]uint64{first, last})
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("copied ranges %v, want %v", got, want)
+	}
+
+	rf.WriteSyncedFile(&resp, resPath, false)
+	AssertSameContent(t, srcPath, resPath)
+}
+
+func TestSelfReferences(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "self_rem.sync")
+	srcPath := path.Join(dir, "self_src.sync")
+
+	r := mrand.New(mrand.NewSource(13))
+	rem := make([]byte, 16<<10)
+	repeated := make([]byte, 20000)
+	between := make([]byte, 3000)
+	r.Read(rem)
+	r.Read(repeated)
+	r.Read(between)
+
+	// the repeated section is new, only its first copy has to be sent
+	src := bytes.Join([][]byte{rem[:8<<10], repeated, between, repeated, rem[8<<10:]}, nil)
+	os.WriteFile(remPath, rem, 0644)
+	os.WriteFile(srcPath, src, 0644)
+
+	literalSize := func(resp file_level.Response) (size int) {
+		for _, packet := range resp {
+			if packet.BlockType == file_level.A_BLOCK {
+				size += len(packet.Data)
+			}
+		}
+		return size
+	}
+
+	for _, chunking := range []file_level.ChunkingMode{file_level.CHUNKING_FIXED, file_level.CHUNKING_CDC} {
+		params := file_level.DefaultSyncParams()
+		params.BlockSize = 1024
+		params.Chunking = chunking
+		rf := CreateRemoteFile(t, remPath, params)
+
+		search := func(selfRefs bool) file_level.Response {
+			sf := CreateSourceFile(t, srcPath, params)
+			ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.SelfRefs = selfRefs
+			return Search(t, &ex)
+		}
+
+		plain := search(false)
+		resp := search(true)
+
+		if saved := literalSize(plain) - literalSize(resp); saved < len(repeated)-4*int(params.BlockSize) {
+			t.Errorf("%v: self references saved %d literal bytes", chunking, saved)
+		}
+		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+			file_level.S_BLOCK: 1,
+		})
+
+		resPath := path.Join(dir, fmt.Sprintf("self_res_%v.sync", chunking))
+		if err := rf.WriteSyncedFile(&resp, resPath, false); err != nil {
+			t.Fatal(err)
+		}
+		AssertSameContent(t, srcPath, resPath)
+	}
+
+	t.Run("Copy past the written data", func(t *testing.T) {
+		rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+		resp := file_level.Response{
+			{BlockType: file_level.A_BLOCK, Data: make([]byte, 100)},
+			{BlockType: file_level.S_BLOCK, Data: binary.LittleEndian.AppendUint64(
+				binary.LittleEndian.AppendUint64(nil, 50), 51)},
+		}
+		err := rf.WriteSyncedFile(&resp, path.Join(dir, "self_bad.sync"), false)
+		if !errors.Is(err, file_level.ErrSelfRange) {
+			t.Errorf("got %v, want %v", err, file_level.ErrSelfRange)
+		}
+	})
+}
+
+func TestDeltaFile(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	const remPath = "test_data/writeFile/2_chunk_128_rem.sync"
+	dir := t.TempDir()
+
+	rf := CreateRemoteFile(t, remPath, file_level.DefaultSyncParams())
+	sf := CreateSourceFile(t, hostPath, file_level.DefaultSyncParams())
+	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	// literal data as well as a copy
+	resp := append(file_level.Response{{BlockType: file_level.A_BLOCK, Data: []byte("hello")}}, Search(t, &ex)...)
+
+	fileHash, err := file_level.GetFileHash(hostPath, sf.Params.HashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := file_level.DeltaHeader{Params: sf.Params, SourceSize: sf.FileSize, FileHash: fileHash}
+
+	var delta bytes.Buffer
+	dw, err := file_level.NewDeltaWriter(&delta, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range resp {
+		if err := dw.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Read back", func(t *testing.T) {
+		dr, err := file_level.NewDeltaReader(bytes.NewReader(delta.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(header, dr.Header) {
+			t.Errorf("header %v, want %v", dr.Header, header)
+		}
+
+		var got file_level.Response
+		if err := dr.WriteTo(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(resp, got) {
+			t.Errorf("packets %v, want %v", got, resp)
+		}
+	})
+
+	t.Run("Stable encoding", func(t *testing.T) {
+		var golden bytes.Buffer
+		dw, _ := file_level.NewDeltaWriter(&golden, file_level.DeltaHeader{
+			Params:     file_level.SyncParams{BlockSize: 1024, HashAlgorithm: file_level.HASH_XXH3},
+			SourceSize: 2048,
+			FileHash:   []byte{0xaa, 0xbb},
+		})
+		dw.WritePacket(file_level.ResponsePacket{BlockType: file_level.A_BLOCK, Data: []byte("hi")})
+		dw.WritePacket(file_level.ResponsePacket{BlockType: file_level.R_BLOCK,
+			Data: binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, 1), 2)})
+		dw.Close()
+
+		want := "53594446" + "0100" + "0004000000000000" + "03" + "00" + "0008000000000000" + "02aabb" +
+			"01026869" + "0410" + "01000000000000000200000000000000" + "ff02"
+		if got := fmt.Sprintf("%x", golden.Bytes()); got != want {
+			t.Errorf("delta file encoded as\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("Broken files", func(t *testing.T) {
+		data := delta.Bytes()
+		cases := map[string]struct {
+			data []byte
+			want error
+		}{
+			"magic":     {append([]byte("XYDF"), data[4:]...), file_level.ErrDeltaMagic},
+			"version":   {append([]byte("SYDF\x02\x00"), data[6:]...), file_level.ErrDeltaVersion},
+			"truncated": {data[:len(data)-10], file_level.ErrCorruptDelta},
+			"no end":    {data[:len(data)-2], file_level.ErrCorruptDelta},
+		}
+
+		for name, c := range cases {
+			dr, err := file_level.NewDeltaReader(bytes.NewReader(c.data))
+			if err == nil {
+				err = dr.WriteTo(&file_level.Response{})
+			}
+			if !errors.Is(err, c.want) {
+				t.Errorf("%s: got %v, want %v", name, err, c.want)
+			}
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		dr, err := file_level.NewDeltaReader(bytes.NewReader(delta.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// skip the extra literal
+		dr.Next()
+
+		resPath := path.Join(dir, "delta_res.sync")
+		w, err := rf.NewSyncedFileWriter(resPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dr.WriteTo(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		AssertSameContent(t, hostPath, resPath)
+	})
+
+	t.Run("Apply without signatures", func(t *testing.T) {
+		for _, chunking := range []file_level.ChunkingMode{file_level.CHUNKING_FIXED, file_level.CHUNKING_CDC} {
+			params := file_level.SyncParams{BlockSize: 64, HashAlgorithm: file_level.HASH_SHA256, Chunking: chunking}
+			rf := CreateRemoteFile(t, remPath, params)
+			sf := CreateSourceFile(t, hostPath, params)
+			ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			resp := Search(t, &ex)
+
+			basis, err := file_level.CreatePatchBasis(remPath, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(basis.ChunkList) != len(rf.ChunkList) {
+				t.Fatalf("%v: %d chunks, want %d", chunking, len(basis.ChunkList), len(rf.ChunkList))
+			}
+			for idx, chunk := range basis.ChunkList {
+				want := rf.ChunkList[idx]
+				if chunk.Offset != want.Offset || chunk.Size != want.Size || chunk.StrongHash != nil {
+					t.Fatalf("%v: chunk %d is %v, want %d bytes at %d without a hash", chunking, idx, chunk, want.Size, want.Offset)
+				}
+			}
+
+			resPath := path.Join(dir, "delta_basis_res.sync")
+			if err := basis.WriteSyncedFile(&resp, resPath, false); err != nil {
+				t.Fatal(err)
+			}
+			AssertSameContent(t, hostPath, resPath)
+		}
+	})
+}
+
+func TestSignatureFile(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "signature_rem.sync")
+	data := make([]byte, 1<<20+321)
+	mrand.New(mrand.NewSource(14)).Read(data)
+	os.WriteFile(filePath, data, 0644)
+
+	for _, chunking := range []file_level.ChunkingMode{file_level.CHUNKING_FIXED, file_level.CHUNKING_CDC} {
+		params := file_level.SyncParams{BlockSize: 1000, HashAlgorithm: file_level.HASH_BLAKE2B, Chunking: chunking}
+
+		var sig bytes.Buffer
+		sigw, err := file_level.NewSignatureWriter(&sig, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := file_level.CreateRemoteFileStream(filePath, params, 4, sigw.WriteChunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sigw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := file_level.ReadSignature(bytes.NewReader(sig.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Params != params || got.ChunkCount != want.ChunkCount || !cmp.Equal(want.ChunkList, got.ChunkList) {
+			t.Errorf("%v: signature file does not read back the same chunks", chunking)
+		}
+
+		for name, broken := range map[string][]byte{
+			"truncated": sig.Bytes()[:sig.Len()-100],
+			"no end":    sig.Bytes()[:sig.Len()-3],
+		} {
+			if _, err := file_level.ReadSignature(bytes.NewReader(broken)); !errors.Is(err, file_level.ErrCorruptSignature) {
+				t.Errorf("%v %s: got %v, want %v", chunking, name, err, file_level.ErrCorruptSignature)
+			}
+		}
+	}
+
+	if _, err := file_level.ReadSignature(bytes.NewReader([]byte("SYDF"))); !errors.Is(err, file_level.ErrSignatureMagic) {
+		t.Errorf("got %v, want %v", err, file_level.ErrSignatureMagic)
+	}
+}
+
+// the golden files follow the librsync formats, a 5000 byte basis in
+// 512 byte blocks and a new file made of moved blocks and literal data
+func TestRdiff(t *testing.T) {
+	const dir = "test_data/rdiff"
+	basisPath := path.Join(dir, "basis.bin")
+	newPath := path.Join(dir, "new.bin")
+	basis, err := os.ReadFile(basisPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDelta, err := os.ReadFile(path.Join(dir, "new.min.delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signatures := map[string]file_level.SyncParams{
+		"basis.md4.sig": {BlockSize: 512, HashAlgorithm: file_level.HASH_MD4,
+			Rolling: file_level.ROLLING_ROLLSUM, StrongSize: 16},
+		"basis.blake2.sig": {BlockSize: 512, HashAlgorithm: file_level.HASH_BLAKE2B,
+			Rolling: file_level.ROLLING_ROLLSUM, StrongSize: 8},
+		"basis.rk-blake2.sig": {BlockSize: 512, HashAlgorithm: file_level.HASH_BLAKE2B,
+			Rolling: file_level.ROLLING_RABINKARP, StrongSize: 32},
+	}
+	for name, params := range signatures {
+		golden, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sig bytes.Buffer
+		sigw, err := file_level.NewRdiffSignatureWriter(&sig, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file_level.CreateRemoteFileStream(basisPath, params, 1, sigw.WriteChunks); err != nil {
+			t.Fatal(err)
+		}
+		if err := sigw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig.Bytes(), golden) {
+			t.Errorf("%s: written signature differs from the test file", name)
+		}
+
+		rf, err := file_level.ReadRdiffSignature(bytes.NewReader(golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rf.Params != params || rf.ChunkCount != 10 {
+			t.Fatalf("%s: read %d chunks with %+v", name, rf.ChunkCount, rf.Params)
+		}
+
+		sf := CreateSourceFile(t, newPath, rf.Params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delta bytes.Buffer
+		dw, err := file_level.NewRdiffDeltaWriter(&delta, &rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.SearchTo(dw); err != nil {
+			t.Fatal(err)
+		}
+		if err := dw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(delta.Bytes(), wantDelta) {
+			t.Errorf("%s: delta is\n%x\nwant\n%x", name, delta.Bytes(), wantDelta)
+		}
+
+		var got bytes.Buffer
+		if err := file_level.PatchRdiff(bytes.NewReader(basis), &delta, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s: patched file differs from the new file", name)
+		}
+
+		if _, err := file_level.ReadRdiffSignature(bytes.NewReader(golden[:len(golden)-3])); !errors.Is(err, file_level.ErrCorruptSignature) {
+			t.Errorf("%s truncated: got %v, want %v", name, err, file_level.ErrCorruptSignature)
+		}
+	}
+
+	// basis.bin is not a multiple of the block size
+	t.Run("Short last block", func(t *testing.T) {
+		golden, err := os.ReadFile(path.Join(dir, "basis.blake2.sig"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf, err := file_level.ReadRdiffSignature(bytes.NewReader(golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []uint64{uint64(len(basis)) - 392, uint64(len(basis)) + 200} {
+			if err := rf.SetRdiffBasisSize(size); !errors.Is(err, file_level.ErrCorruptSignature) {
+				t.Errorf("basis of %d bytes: got %v, want %v", size, err, file_level.ErrCorruptSignature)
+			}
+		}
+		if err := rf.SetRdiffBasisSize(uint64(len(basis))); err != nil {
+			t.Fatal(err)
+		}
+		if last := rf.ChunkList[rf.ChunkCount-1]; last.Offset+last.Size != uint64(len(basis)) {
+			t.Fatalf("last chunk of %d bytes at %d", last.Size, last.Offset)
+		}
+
+		// the source ends with the short last block of the basis
+		tailSrc := append(append([]byte(nil), want...), basis[len(basis)-392:]...)
+		tailPath := path.Join(t.TempDir(), "tail.bin")
+		os.WriteFile(tailPath, tailSrc, 0644)
+
+		sf := CreateSourceFile(t, tailPath, rf.Params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp file_level.Response
+		if err := ex.SearchTo(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if last := resp[len(resp)-1]; last.BlockType != file_level.B_BLOCK {
+			t.Errorf("the short last block was sent as a %v packet", last.BlockType)
+		}
+
+		var delta bytes.Buffer
+		dw, err := file_level.NewRdiffDeltaWriter(&delta, &rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range resp {
+			if err := dw.WritePacket(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err := file_level.PatchRdiff(bytes.NewReader(basis), &delta, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), tailSrc) {
+			t.Errorf("patched file differs from the source")
+		}
+	})
+
+	// the signature files were not written by rdiff, so their records are
+	// checked against hashes and checksums computed apart from file_level
+	t.Run("Signatures follow the librsync format", func(t *testing.T) {
+		rollsum := func(block []byte) uint32 {
+			var s1, s2 uint32
+			for _, el := range block {
+				s1 += uint32(el) + 31
+				s2 += s1
+			}
+			return s2<<16 | s1&0xffff
+		}
+		rabinkarp := func(block []byte) uint32 {
+			sum := uint32(1)
+			for _, el := range block {
+				sum = sum*0x08104225 + uint32(el)
+			}
+			return sum
+		}
+		md4Sum := func(block []byte) []byte {
+			h := md4.New()
+			h.Write(block)
+			return h.Sum(nil)
+		}
+		blake2Sum := func(block []byte) []byte {
+			sum := blake2b.Sum256(block)
+			return sum[:]
+		}
+
+		for name, c := range map[string]struct {
+			magic      uint32
+			strongSize int
+			weak       func([]byte) uint32
+			strong     func([]byte) []byte
+		}{
+			"basis.md4.sig":       {0x72730136, 16, rollsum, md4Sum},
+			"basis.blake2.sig":    {0x72730137, 8, rollsum, blake2Sum},
+			"basis.rk-blake2.sig": {0x72730147, 32, rabinkarp, blake2Sum},
+		} {
+			golden, err := os.ReadFile(path.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := binary.BigEndian.AppendUint32(nil, c.magic)
+			want = binary.BigEndian.AppendUint32(want, 512)
+			want = binary.BigEndian.AppendUint32(want, uint32(c.strongSize))
+			for offset := 0; offset < len(basis); offset += 512 {
+				block := basis[offset:]
+				if len(block) > 512 {
+					block = block[:512]
+				}
+				want = binary.BigEndian.AppendUint32(want, c.weak(block))
+				want = append(want, c.strong(block)[:c.strongSize]...)
+			}
+			if !bytes.Equal(golden, want) {
+				t.Errorf("%s: signature file is\n%x\nwant\n%x", name, golden, want)
+			}
+		}
+	})
+
+	// the only check against librsync itself, the commands
+	// are the ones of test_data/rdiff/README.md
+	t.Run("Against an installed rdiff", func(t *testing.T) {
+		if _, err := exec.LookPath("rdiff"); err != nil {
+			t.Skip("rdiff is not installed")
+		}
+		tmp := t.TempDir()
+		rdiff := func(args ...string) {
+			if out, err := exec.Command("rdiff", args...).CombinedOutput(); err != nil {
+				t.Fatalf("rdiff %v: %v\n%s", args, err, out)
+			}
+		}
+
+		for name, args := range map[string][]string{
+			"basis.md4.sig":       {"-S", "16", "-H", "md4", "-R", "rollsum"},
+			"basis.blake2.sig":    {"-S", "8", "-H", "blake2", "-R", "rollsum"},
+			"basis.rk-blake2.sig": {"-S", "32", "-H", "blake2", "-R", "rabinkarp"},
+		} {
+			sigPath := path.Join(tmp, name)
+			rdiff(append(append([]string{"-b", "512"}, args...), "signature", basisPath, sigPath)...)
+			AssertSameContent(t, path.Join(dir, name), sigPath)
+
+			deltaPath := path.Join(tmp, name+".delta")
+			rdiff("delta", sigPath, newPath, deltaPath)
+			delta, err := os.ReadFile(deltaPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := file_level.PatchRdiff(bytes.NewReader(basis), bytes.NewReader(delta), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s: the delta of rdiff patched to a different file", name)
+			}
+		}
+
+		outPath := path.Join(tmp, "new.out")
+		rdiff("patch", basisPath, path.Join(dir, "new.min.delta"), outPath)
+		AssertSameContent(t, newPath, outPath)
+	})
+
+	t.Run("Patch with every command", func(t *testing.T) {
+		delta, err := os.ReadFile(path.Join(dir, "new.delta"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got bytes.Buffer
+		if err := file_level.PatchRdiff(bytes.NewReader(basis), bytes.NewReader(delta), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("patched file differs from the new file")
+		}
+
+		// the 4 and 8 byte widths, new.delta only has the narrow ones
+		wide := binary.BigEndian.AppendUint32(nil, 0x72730236)
+		wide = append(wide, 0x43)
+		wide = binary.BigEndian.AppendUint32(wide, 3)
+		wide = append(wide, "abc"...)
+		wide = append(wide, 0x54)
+		wide = binary.BigEndian.AppendUint64(wide, 100)
+		wide = binary.BigEndian.AppendUint64(wide, 1000)
+		wide = append(wide, 0x44)
+		wide = binary.BigEndian.AppendUint64(wide, 2)
+		wide = append(wide, "de"...)
+		wide = append(wide, 0x4f)
+		wide = binary.BigEndian.AppendUint32(wide, 4000)
+		wide = binary.BigEndian.AppendUint32(wide, 1)
+		wide = append(wide, 0x01, 'f', 0x00)
+		wideWant := append(append(append(append([]byte("abc"), basis[100:1100]...), "de"...), basis[4000:4001]...), 'f')
+		got.Reset()
+		if err := file_level.PatchRdiff(bytes.NewReader(basis), bytes.NewReader(wide), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), wideWant) {
+			t.Errorf("patched the wide commands to\n%q\nwant\n%q", got.Bytes(), wideWant)
+		}
+
+		for name, broken := range map[string][]byte{
+			"no end":         delta[:len(delta)-1],
+			"truncated":      delta[:len(delta)-100],
+			"past the basis": {0x72, 0x73, 0x02, 0x36, 0x4a, 0x13, 0x00, 0x02, 0x00, 0x00},
+			"unknown":        {0x72, 0x73, 0x02, 0x36, 0x55},
+		} {
+			err := file_level.PatchRdiff(bytes.NewReader(basis), bytes.NewReader(broken), &bytes.Buffer{})
+			if !errors.Is(err, file_level.ErrCorruptDelta) {
+				t.Errorf("%s: got %v, want %v", name, err, file_level.ErrCorruptDelta)
+			}
+		}
+	})
+
+	t.Run("Formats rdiff does not know", func(t *testing.T) {
+		if _, err := file_level.ReadRdiffSignature(bytes.NewReader([]byte("SYSF\x01\x00\x00\x00\x00\x00\x00\x00"))); !errors.Is(err, file_level.ErrRdiffMagic) {
+			t.Errorf("got %v, want %v", err, file_level.ErrRdiffMagic)
+		}
+		if _, err := file_level.NewRdiffSignatureWriter(&bytes.Buffer{}, file_level.DefaultSyncParams()); !errors.Is(err, file_level.ErrRdiffParams) {
+			t.Errorf("got %v, want %v", err, file_level.ErrRdiffParams)
+		}
+
+		dw, err := file_level.NewRdiffDeltaWriter(&bytes.Buffer{}, &file_level.RemoteFile{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dw.WritePacket(file_level.ResponsePacket{BlockType: file_level.Z_BLOCK}); !errors.Is(err, file_level.ErrPacketType) {
+			t.Errorf("got %v, want %v", err, file_level.ErrPacketType)
+		}
+	})
+}
+
+// rolling a window has to give the checksum of the window it rolled to
+func TestRollingChecksum(t *testing.T) {
+	data := make([]byte, 3000)
+	mrand.New(mrand.NewSource(16)).Read(data)
+	const size = 700
+
+	for _, rolling := range []file_level.RollingChecksum{
+		file_level.ROLLING_RSYNC, file_level.ROLLING_ROLLSUM, file_level.ROLLING_RABINKARP,
+	} {
+		sum, a_sum, b_sum := rolling.Sum(data[:size])
+		for idx := 1; idx+size <= len(data); idx++ {
+			sum, a_sum, b_sum = rolling.Roll(a_sum, b_sum, size, data[idx-1], data[idx+size-1])
+			if want, _, _ := rolling.Sum(data[idx : idx+size]); sum != want {
+				t.Fatalf("%v: rolled to %d got %x, want %x", rolling, idx, sum, want)
+			}
+		}
+	}
+}
+
+func TestWholeFile(t *testing.T) {
+	const hostPath = "test_data/writeFile/2_chunk_128_src.sync"
+	dir := t.TempDir()
+	params := file_level.DefaultSyncParams()
+
+	for name, destPath := range map[string]string{
+		"new file":      path.Join(dir, "whole_new.sync"),
+		"existing file": path.Join(dir, "whole_existing.sync"),
+	} {
+		os.WriteFile(path.Join(dir, "whole_existing.sync"), []byte("old content"), 0644)
+
+		for _, level := range []int{0, file_level.DEFAULT_COMPRESS_LEVEL} {
+			sf := CreateSourceFile(t, hostPath, params)
+			writer, err := file_level.NewWholeFileWriter(destPath, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var resp file_level.Response
+			var sink file_level.PacketSink = &resp
+			if level != 0 {
+				if sink, err = file_level.NewCompressSink(&resp, level); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sf.WholeFileTo(sink); err != nil {
+				t.Fatal(err)
+			}
+			for _, packet := range resp {
+				if packet.BlockType != file_level.A_BLOCK && packet.BlockType != file_level.Z_BLOCK {
+					t.Fatalf("%s: got a %v packet", name, packet.BlockType)
+				}
+				if err := writer.WritePacket(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			AssertSameContent(t, hostPath, destPath)
+		}
+	}
+
+	writer, err := file_level.NewWholeFileWriter(path.Join(dir, "whole_block.sync"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Abort()
+	if err := writer.WritePacket(file_level.ResponsePacket{
+		BlockType: file_level.B_BLOCK,
+		Data:      make([]byte, 8),
+	}); !errors.Is(err, file_level.ErrChunkIndex) {
+		t.Errorf("copy without a basis: got %v, want %v", err, file_level.ErrChunkIndex)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	t.Run("Block size picked from file size", func(t *testing.T) {
+		cases := map[uint64]uint64{
+			0:         file_level.AUTO_MIN_BLOCK_SIZE,
+			100000:    file_level.AUTO_MIN_BLOCK_SIZE,
+			1 << 20:   1024,
+			1 << 40:   file_level.MAX_BLOCK_SIZE,
+			123456789: 11104,
+		}
+
+		for fileSize, want := range cases {
+			if got := file_level.BlockSizeFor(fileSize); got != want {
+				t.Errorf("BlockSizeFor(%d) = %d, want %d", fileSize, got, want)
+			}
+		}
+	})
+
+	t.Run("128 Blocks with 1024 byte blocks", func(t *testing.T) {
+		const default_path_src = "test_data/typeB/128_block_src.sync"
+		const default_path_rem = "test_data/typeB/128_block_rem.sync"
+		params := file_level.SyncParams{BlockSize: 1024}
+
+		rf := CreateRemoteFile(t, default_path_rem, params)
+		sf := CreateSourceFile(t, default_path_src, params)
+		ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := Search(t, &ex)
+
+		AssertPackageTypeByCount(t, resp, map[file_level.ResponseType]int{
+			file_level.A_BLOCK: 0,
+			file_level.B_BLOCK: 0,
+			file_level.R_BLOCK: 1,
+		})
+	})
+
+	t.Run("Mismatched block size", func(t *testing.T) {
+		const default_path_src = "test_data/typeB/2_block_src.sync"
+		const default_path_rem = "test_data/typeB/2_block_rem.sync"
+
+		rf := CreateRemoteFile(t, default_path_rem, file_level.SyncParams{BlockSize: 1024})
+		sf := CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
+		if _, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList); err != file_level.ErrBlockSizeMismatch {
+			t.Errorf("got %v, want %v", err, file_level.ErrBlockSizeMismatch)
+		}
+
+		// only the last chunk can be short
+		rf = CreateRemoteFile(t, default_path_rem, file_level.DefaultSyncParams())
+		rf.ChunkList[0].Size = 100
+		sf = CreateSourceFile(t, default_path_src, file_level.DefaultSyncParams())
+		if _, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList); err != file_level.ErrBlockSizeMismatch {
+			t.Errorf("short first chunk: got %v, want %v", err, file_level.ErrBlockSizeMismatch)
+		}
+	})
+}
+
+func TestStrongHash(t *testing.T) {
+	data := make([]byte, 768)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+
+	cases := []struct {
+		algo file_level.HashAlgorithm
+		data []byte
+		want string
+	}{
+		{file_level.HASH_XXH3, data[:0], "99aa06d3014798d86001c324468d497f"},
+		{file_level.HASH_XXH3, []byte("abc"), "06b05ab6733a618578af5f94892f3950"},
+		{file_level.HASH_XXH3, data[:100], "da95ef16fd9566f329b20ba5f03ec01e"},
+		{file_level.HASH_XXH3, data, "a9ee10cbf43517e44066a57f4496584a"},
+		{file_level.HASH_BLAKE2B, data[:0], "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{file_level.HASH_BLAKE2B, []byte("abc"), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{file_level.HASH_BLAKE2B, data[:100], "5ac86383dec1db602fdbc2c978c3fe1bf4328fea1e1b495b68be2c3b67ba033b"},
+		{file_level.HASH_BLAKE2B, data, "b8007121274217790e2923e0ad7027986e5a99d5531ef6ae7d294140fc81615d"},
+		{file_level.HASH_MD4, data[:0], "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{file_level.HASH_MD4, []byte("abc"), "a448017aaf21d8525fc10ae87aa6729d"},
+		{file_level.HASH_MD4, []byte("12345678901234567890123456789012345678901234567890123456789012345678901234567890"),
+			"e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+
+	for _, c := range cases {
+		hasher, err := c.algo.Hasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fmt.Sprintf("%x", hasher.Sum(c.data)); got != c.want {
+			t.Errorf("%v(%d bytes) = %s, want %s", c.algo, len(c.data), got, c.want)
+		}
+
+		// feed the streaming hash in uneven pieces to cover its buffering
+		h := hasher.New()
+		for rest := c.data; len(rest) > 0; {
+			n := 7 + len(rest)%61
+			if n > len(rest) {
+				n = len(rest)
+			}
+			h.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != c.want {
+			t.Errorf("streaming %v(%d bytes) = %s, want %s", c.algo, len(c.data), got, c.want)
+		}
+	}
+
+	t.Run("MD4 is only for rdiff signatures", func(t *testing.T) {
+		if _, err := file_level.ParseHashAlgorithm("md4"); !errors.Is(err, file_level.ErrUnknownHash) {
+			t.Errorf("parsing md4: got %v, want %v", err, file_level.ErrUnknownHash)
+		}
+		for _, name := range file_level.HashAlgorithmNames() {
+			if name == "md4" {
+				t.Errorf("md4 is in %v", file_level.HashAlgorithmNames())
+			}
+		}
+
+		params := file_level.DefaultSyncParams()
+		params.HashAlgorithm = file_level.HASH_MD4
+		if err := params.Validate(); !errors.Is(err, file_level.ErrUnknownHash) {
+			t.Errorf("validating md4 params: got %v, want %v", err, file_level.ErrUnknownHash)
+		}
+	})
+
+	t.Run("Search with every algorithm", func(t *testing.T) {
+		const default_path_src = "test_data/writeFile/2_chunk_128_src.sync"
+		const default_path_rem = "test_data/writeFile/2_chunk_128_rem.sync"
+
+		for _, name := range file_level.HashAlgorithmNames() {
+			algo, err := file_level.ParseHashAlgorithm(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := file_level.DefaultSyncParams()
+			params.HashAlgorithm = algo
+
+			rf := CreateRemoteFile(t, default_path_rem, params)
+			sf := CreateSourceFile(t, default_path_src, params)
+			ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			AssertPackageTypeByCount(t, Search(t, &ex), map[file_level.ResponseType]int{
+				file_level.A_BLOCK: 0,
+				file_level.B_BLOCK: 0,
+				file_level.R_BLOCK: 1,
+			})
+		}
+	})
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	dir := t.TempDir()
+	remPath := path.Join(dir, "cdc_rem.sync")
+	srcPath := path.Join(dir, "cdc_src.sync")
+	resPath := path.Join(dir, "cdc_res.sync")
+
+	rem := make([]byte, 1<<20)
+	mrand.New(mrand.NewSource(26)).Read(rem)
+	// an insertion shifts every following byte, fixed blocks would all miss
+	src := append(append(append([]byte(nil), rem[:300000]...), []byte("inserted bytes")...), rem[300000:]...)
+	if err := os.WriteFile(remPath, rem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcPath, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := file_level.DefaultSyncParams()
+	params.Chunking = file_level.CHUNKING_CDC
+
+	rf := CreateRemoteFile(t, remPath, params)
+	sf := CreateSourceFile(t, srcPath, params)
+	ex, err := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := Search(t, &ex)
+
+	literal := 0
+	for _, packet := range resp {
+		if packet.BlockType == file_level.A_BLOCK {
+			literal += len(packet.Data)
+		}
+	}
+	if max := 3 * int(file_level.CDCMaxSize(params.BlockSize)); literal > max {
+		t.Errorf("sent %d literal bytes for a %d byte insertion, want at most %d", literal, 14, max)
+	}
+
+	rf.WriteSyncedFile(&resp, resPath, false)
+	AssertSameContent(t, srcPath, resPath)
+}
+
+func AssertPackageTypeByCount(t testing.TB, resp file_level.Response, wantMap map[file_level.ResponseType]int) {
+	t.Helper()
+	gotMap := map[file_level.ResponseType]int{}
+
+	for _, pack := range resp {
+		gotMap[pack.BlockType]++
+	}
+
+	var mismatched []file_level.ResponseType
+	for key, val := range wantMap {
+		if val != gotMap[key] {
+			mismatched = append(mismatched, key)
+		}
+	}
+	if len(mismatched) > 0 {
+		sort.Slice(mismatched, func(i, j int) bool { return mismatched[i] < mismatched[j] })
+		t.Errorf(
+			"Search failed, wrong count of %v\n"+
+				"received %v\n"+
+				"wanted   %v\n",
+			mismatched, gotMap, wantMap,
+		)
+	}
+}
+
+func AssertSameContent(t testing.TB, wantPath, gotPath string) {
+	t.Helper()
+	want, err := os.ReadFile(wantPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(gotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s differs from %s", gotPath, wantPath)
+	}
+}
+
+// dir holds wantCount files and none of them is a leftover temporary file
+func AssertNoTempFiles(t testing.TB, dir string, wantCount int) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+	if len(entries) != wantCount {
+		t.Errorf("%s has %d files, want %d", dir, len(entries), wantCount)
+	}
+}
+
+func CreateRemoteFile(t testing.TB, filePath string, params file_level.SyncParams) file_level.RemoteFile {
+	t.Helper()
+	rf, err := file_level.CreateRemoteFileWithParams(filePath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rf
+}
+
+func CreateSourceFile(t testing.TB, filePath string, params file_level.SyncParams) file_level.SourceFile {
+	t.Helper()
+	sf, err := file_level.CreateSourceFileWithParams(filePath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sf.File.Close() })
+	return sf
+}
+
+func ReadFS(t testing.TB, fsys file_level.FS, filePath string) []byte {
+	t.Helper()
+	file, err := fsys.OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func WriteFS(t testing.TB, fsys file_level.FS, filePath string, data []byte) {
+	t.Helper()
+	file, err := fsys.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Search(t testing.TB, ex *file_level.RsyncExchange) file_level.Response {
+	t.Helper()
+	resp, err := ex.Search()
+	if err != nil {
+		t.Fatal(err)
 	}
+	return resp
 }
@@ -191,15 +191,24 @@ func MakeSearchTestHelper(t testing.TB, sourceFilePath, remoteFilePath, resFileP
 	creationResp *file_level.Response) {
 	t.Helper()
 
-	sf := file_level.CreateSourceFile(sourceFilePath)
-	rf := file_level.CreateRemoteFile(remoteFilePath)
+	sf, err := file_level.CreateSourceFile(sourceFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf, err := file_level.CreateRemoteFile(remoteFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
 	ex, _ := file_level.CreateRsyncExchange(&sf, rf.ChunkList)
 	defer sf.File.Close()
 	defer rf.File.Close()
-	resp := ex.Search()
+	resp, err := ex.Search()
+	if err != nil {
+		t.Fatal(err)
+	}
 	rf.WriteSyncedFile(&resp, resFilePath, false)
 
-	if logFilePath != "" && !AssertFileHash(t, sf.File, rf.File) {
+	if logFilePath != "" && !AssertFileHash(t, sf.File.(*os.File), rf.File.(*os.File)) {
 		logFile, err := os.Create(logFilePath)
 		if err != nil {
 			t.Fatal(err)
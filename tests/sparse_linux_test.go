@@ -0,0 +1,19 @@
+package sync_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// the file takes less space on the disk than its size
+func AssertSparse(t testing.TB, filePath string) {
+	t.Helper()
+	stats, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := stats.Sys().(*syscall.Stat_t).Blocks * 512; used >= stats.Size() {
+		t.Errorf("%s uses %d bytes for %d, it has no holes", filePath, used, stats.Size())
+	}
+}